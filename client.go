@@ -0,0 +1,116 @@
+package exporter
+
+import (
+	"fmt"
+)
+
+// clientKey is the key of cached metric clients. Exactly one of the fields is set.
+type clientKey struct {
+	credentialsID string
+	projectID     string
+}
+
+// sharedClient is a cached metric client, with the number of project data using it.
+type sharedClient struct {
+	client metricClient
+	refs   int
+}
+
+// clientForProject returns the metric client for the project. Clients made from
+// ClientOptionsForProject are cached per credentials ID, so that projects with the same
+// credentials share a client. Projects without credentials IDs have their own clients. For cached
+// clients, key is returned, and the caller must call releaseClient() with it when the client is no
+// longer used. key is nil for the metric client of the exporter.
+func (e *StatsExporter) clientForProject(projectID string) (client metricClient, key *clientKey, err error) {
+	switch e.client.(type) {
+	case *dryRunClient, sinkClient:
+		return e.client, nil, nil
+	}
+	if e.opts.ClientOptionsForProject == nil {
+		return e.client, nil, nil
+	}
+	credentialsID, clientOpts, err := e.opts.ClientOptionsForProject(projectID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get client options for project %s: %v", projectID, err)
+	}
+	if len(clientOpts) == 0 {
+		return e.client, nil, nil
+	}
+
+	// Client options are opaque, so we can't tell whether two sets of them are same, and only
+	// the caller can tell which projects share credentials.
+	key = &clientKey{credentialsID: credentialsID}
+	if credentialsID == "" {
+		key = &clientKey{projectID: projectID}
+	}
+	e.clientMu.Lock()
+	defer e.clientMu.Unlock()
+	if shared, ok := e.clients[*key]; ok {
+		shared.refs++
+		return shared.client, key, nil
+	}
+	client, err = newMetricClient(e.ctx, clientOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create a metric client for project %s: %v", projectID, err)
+	}
+	e.clients[*key] = &sharedClient{client: client, refs: 1}
+	return client, key, nil
+}
+
+// releaseClient releases the cached metric client of the key used by a project data, and closes
+// the client when no project data use it any more.
+func (e *StatsExporter) releaseClient(key clientKey) error {
+	e.clientMu.Lock()
+	defer e.clientMu.Unlock()
+	shared, ok := e.clients[key]
+	if !ok {
+		return nil
+	}
+	if shared.refs--; 0 < shared.refs {
+		return nil
+	}
+	delete(e.clients, key)
+	return shared.client.Close()
+}
+
+// closeClients closes all metric clients of the exporter. When closing some of them fails, the
+// first error is returned.
+func (e *StatsExporter) closeClients() error {
+	err := e.client.Close()
+	e.clientMu.Lock()
+	defer e.clientMu.Unlock()
+	for _, shared := range e.clients {
+		if closeErr := shared.client.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// metricClient returns the metric client of the project, which is resolved on first use. Failures
+// are not cached, so that they are retried on next use.
+func (pd *projectData) metricClient() (metricClient, error) {
+	pd.clientMu.Lock()
+	defer pd.clientMu.Unlock()
+	if pd.client == nil {
+		client, key, err := pd.parent.clientForProject(pd.projectID)
+		if err != nil {
+			return nil, err
+		}
+		pd.client, pd.clientKey = client, key
+	}
+	return pd.client, nil
+}
+
+// releaseClient releases the metric client of the project, if it's cached by the exporter for
+// the project. It's called when the project data is stopped. An error on closing the client is
+// ignored, since there are no row data to report it with.
+func (pd *projectData) releaseClient() {
+	pd.clientMu.Lock()
+	key := pd.clientKey
+	pd.client, pd.clientKey = nil, nil
+	pd.clientMu.Unlock()
+	if key != nil {
+		pd.parent.releaseClient(*key)
+	}
+}
@@ -0,0 +1,270 @@
+package exporter
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	timestamppb "github.com/golang/protobuf/ptypes/timestamp"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// defaultMaxTrackedSeries is the default number of cumulative time series tracked per project.
+const defaultMaxTrackedSeries = 10000
+
+// seriesState is the last exported point of a cumulative time series. rawStart is the start time
+// of the row data, and start is that of the exported point, which may be adjusted.
+type seriesState struct {
+	key             string
+	rawStart, start time.Time
+	end             time.Time
+	value           *monitoringpb.TypedValue
+}
+
+// seriesTracker keeps states of time series of a project. When it has more than max series, least
+// recently used series are forgotten. It should be created by newSeriesTracker().
+type seriesTracker struct {
+	// mu protects all fields below.
+	mu  sync.Mutex
+	max int
+	// lru holds *seriesState with the most recently used one at the front.
+	lru    *list.List
+	states map[string]*list.Element
+	// converting has keys of series whose points are being converted and exported. released is
+	// signaled when a series is released from it.
+	converting map[string]bool
+	released   *sync.Cond
+}
+
+func newSeriesTracker(max int) *seriesTracker {
+	if max <= 0 {
+		max = defaultMaxTrackedSeries
+	}
+	t := &seriesTracker{
+		max:        max,
+		lru:        list.New(),
+		states:     make(map[string]*list.Element),
+		converting: make(map[string]bool),
+	}
+	t.released = sync.NewCond(&t.mu)
+	return t
+}
+
+// tryAcquire marks the series of key as being converted and exported by the caller, and returns
+// false when another caller already does. Points are converted against the state committed after
+// the last export, so conversions of a series by concurrent uploads must not overlap.
+func (t *seriesTracker) tryAcquire(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.converting[key] {
+		return false
+	}
+	t.converting[key] = true
+	return true
+}
+
+// acquire is like tryAcquire, but waits until the series is released by the other caller.
+func (t *seriesTracker) acquire(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.converting[key] {
+		t.released.Wait()
+	}
+	t.converting[key] = true
+}
+
+// release ends conversion of the series of key, after its state is committed.
+func (t *seriesTracker) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.converting, key)
+	t.released.Broadcast()
+}
+
+// get returns the state of the series of key, which is nil for unknown series. The returned state
+// must not be modified.
+func (t *seriesTracker) get(key string) *seriesState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.states[key]; ok {
+		return elem.Value.(*seriesState)
+	}
+	return nil
+}
+
+// commit replaces states of series with states, which are made from points already exported. A
+// state is ignored when the series already has a state not older than it. states may have nil,
+// which are ignored too.
+func (t *seriesTracker) commit(states ...*seriesState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, state := range states {
+		if state == nil {
+			continue
+		}
+		if elem, ok := t.states[state.key]; ok {
+			if elem.Value.(*seriesState).end.Before(state.end) {
+				elem.Value = state
+				t.lru.MoveToFront(elem)
+			}
+			continue
+		}
+		t.states[state.key] = t.lru.PushFront(state)
+		for t.max < t.lru.Len() {
+			oldest := t.lru.Back()
+			t.lru.Remove(oldest)
+			delete(t.states, oldest.Value.(*seriesState).key)
+		}
+	}
+}
+
+// commitStates commits states of series in a request to the tracker of the project, after the
+// request is uploaded. err is the error of the upload, and when it's not nil, only states of time
+// series not in partial failures of err are committed. states has nil for series not tracked.
+func (pd *projectData) commitStates(states []*seriesState, err error) {
+	if pd.tracker == nil {
+		return
+	}
+	if err == nil {
+		pd.tracker.commit(states...)
+		return
+	}
+	failures, ok := parsePartialFailures(err, len(states))
+	if !ok {
+		// We don't know which points are exported.
+		return
+	}
+	succeeded := append([]*seriesState(nil), states...)
+	for _, failure := range failures {
+		for _, idx := range failure.indices {
+			succeeded[idx] = nil
+		}
+	}
+	pd.tracker.commit(succeeded...)
+}
+
+// releaseSeries releases tracked series of states, which makeReq acquired for a request.
+func (pd *projectData) releaseSeries(states []*seriesState) {
+	for _, state := range states {
+		if state != nil {
+			pd.tracker.release(state.key)
+		}
+	}
+}
+
+// timeSeriesKey identifies the time series of ts by its metric, resource and their labels.
+func timeSeriesKey(ts *monitoringpb.TimeSeries) string {
+	var b strings.Builder
+	writeLabels := func(typ string, labels map[string]string) {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString(typ)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "\x00%s=%s", key, labels[key])
+		}
+		b.WriteString("\x01")
+	}
+	writeLabels(ts.Metric.Type, ts.Metric.Labels)
+	writeLabels(ts.Resource.GetType(), ts.Resource.GetLabels())
+	return b.String()
+}
+
+// cumulativeDecreased tells whether cumulative value cur is smaller than last, which means that
+// the series is reset.
+func cumulativeDecreased(cur, last *monitoringpb.TypedValue) bool {
+	switch c := cur.Value.(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		return c.Int64Value < last.GetInt64Value()
+	case *monitoringpb.TypedValue_DoubleValue:
+		return c.DoubleValue < last.GetDoubleValue()
+	case *monitoringpb.TypedValue_DistributionValue:
+		l := last.GetDistributionValue()
+		return l != nil && distributionReset(c.DistributionValue, l)
+	default:
+		return false
+	}
+}
+
+// distributionReset tells whether cumulative distribution cur can't be made by adding values to
+// last, which means that the series is reset. Decrease of the count, any of bucket counts or the
+// sum means a reset, and so does the change of buckets. Sums are computed from means, so they are
+// compared with a small tolerance for rounding errors.
+func distributionReset(cur, last *distributionpb.Distribution) bool {
+	if cur.Count < last.Count || len(cur.BucketCounts) != len(last.BucketCounts) {
+		return true
+	}
+	for i, count := range cur.BucketCounts {
+		if count < last.BucketCounts[i] {
+			return true
+		}
+	}
+	curSum, lastSum := cur.Mean*float64(cur.Count), last.Mean*float64(last.Count)
+	return curSum < lastSum-1e-9*math.Max(math.Abs(lastSum), 1)
+}
+
+// trackCumulative checks the cumulative point of ts made from rd against last, the state of the
+// series, and adjusts start time of the point so that intervals of the series never overlap. It
+// returns the state of the series after the point is exported, or false when the point must not be
+// exported.
+func (pd *projectData) trackCumulative(rd *RowData, ts *monitoringpb.TimeSeries, last *seriesState) (*seriesState, bool) {
+	exp := pd.parent
+	pt := ts.Points[0]
+	start, end := rd.Start, rd.End
+	if last == nil {
+		return &seriesState{rawStart: rd.Start, start: start, end: end, value: pt.Value}, true
+	}
+	if !last.end.Before(end) {
+		exp.onWarning(&Warning{
+			Kind:    CumulativeOutOfOrder,
+			View:    rd.View,
+			RowData: rd,
+			Message: fmt.Sprintf("point of metric %s ending at %v is not later than the last point ending at %v, so it is dropped", ts.Metric.Type, end, last.end),
+		})
+		return nil, false
+	}
+
+	warn := func(kind WarningKind, format string, args ...interface{}) {
+		exp.onWarning(&Warning{
+			Kind:    kind,
+			View:    rd.View,
+			RowData: rd,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	switch {
+	case cumulativeDecreased(pt.Value, last.value) || last.rawStart.Before(rd.Start):
+		// The series is reset, and the new interval must not overlap the last one.
+		if !last.end.Before(start) {
+			adjusted := last.end.Add(time.Millisecond)
+			if !adjusted.Before(end) {
+				adjusted = last.end.Add(end.Sub(last.end) / 2)
+			}
+			warn(CumulativeReset, "metric %s is reset, and start time %v is adjusted to %v", ts.Metric.Type, start, adjusted)
+			start = adjusted
+		} else {
+			warn(CumulativeReset, "metric %s is reset with start time %v", ts.Metric.Type, start)
+		}
+	case rd.Start.Before(last.rawStart):
+		warn(CumulativeStartMoved, "start time %v of metric %s is earlier than the last start time %v, which is kept", rd.Start, ts.Metric.Type, last.rawStart)
+		start = last.start
+	default:
+		// Start time of the series may have been adjusted on the last reset.
+		start = last.start
+	}
+
+	if !start.Equal(rd.Start) {
+		pt.Interval.StartTime = &timestamppb.Timestamp{
+			Seconds: start.Unix(),
+			Nanos:   int32(start.Nanosecond()),
+		}
+	}
+	return &seriesState{rawStart: rd.Start, start: start, end: end, value: pt.Value}, true
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"time"
 
+	"go.opencensus.io/metric/metricdata"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
 )
 
@@ -37,6 +39,8 @@ const (
 	metric1desc = "this is metric 1"
 	metric2name = "metric_2"
 	metric2desc = "this is metric 2"
+	metric3name = "metric_3"
+	metric3desc = "this is metric 3"
 
 	project1 = "project-1"
 	project2 = "project-2"
@@ -69,6 +73,15 @@ var (
 		Aggregation: view.Sum(),
 	}
 
+	// view3 is a distribution view, which is used only for tests on distributions.
+	view3 = &view.View{
+		Name:        metric3name,
+		Description: metric3desc,
+		TagKeys:     nil,
+		Measure:     stats.Float64(metric3name, metric3desc, stats.UnitMilliseconds),
+		Aggregation: view.Distribution(1, 10),
+	}
+
 	// To make verification easy, we require all valid rows should int64 values and all of them
 	// must be distinct.
 	view1row1 = &view.Row{
@@ -91,6 +104,32 @@ var (
 		Tags: []tag.Tag{{key1, value4}, {key2, value5}, {key3, value6}},
 		Data: &view.SumData{Value: 5},
 	}
+	view3row1 = &view.Row{
+		Tags: nil,
+		Data: &view.DistributionData{
+			Count:           2,
+			Min:             0.5,
+			Max:             20,
+			Mean:            10.25,
+			SumOfSquaredDev: 190.125,
+			CountPerBucket:  []int64{1, 0, 1},
+			ExemplarsPerBucket: []*metricdata.Exemplar{
+				{
+					Value:     0.5,
+					Timestamp: endTime1,
+					Attachments: metricdata.Attachments{
+						metricdata.AttachmentKeySpanContext: spanContext1,
+					},
+				},
+				nil,
+				{
+					Value:       20,
+					Timestamp:   endTime1,
+					Attachments: metricdata.Attachments{label1name: value1},
+				},
+			},
+		},
+	}
 	// This Row does not have valid Data field, so is invalid.
 	invalidRow = &view.Row{Data: nil}
 
@@ -99,6 +138,11 @@ var (
 	startTime2 = endTime2.Add(-10 * time.Second)
 	endTime2   = time.Now()
 
+	spanContext1 = trace.SpanContext{
+		TraceID: trace.TraceID{0x1},
+		SpanID:  trace.SpanID{0x2},
+	}
+
 	resource1 = &monitoredrespb.MonitoredResource{
 		Type: "cloudsql_database",
 		Labels: map[string]string{
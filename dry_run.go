@@ -0,0 +1,146 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	gax "github.com/googleapis/gax-go"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// dryRunRecord is a line written by dryRunClient for each RPC call.
+type dryRunRecord struct {
+	Method  string `json:"method"`
+	Project string `json:"project"`
+	// SeriesCount, StartTime and EndTime summarize requests to create time series. StartTime
+	// and EndTime are the earliest start time and the latest end time of points in the request.
+	SeriesCount int    `json:"seriesCount,omitempty"`
+	StartTime   string `json:"startTime,omitempty"`
+	EndTime     string `json:"endTime,omitempty"`
+	// Request is the request in JSON form of protocol buffers.
+	Request json.RawMessage `json:"request"`
+}
+
+// dryRunClient is a metricClient writing requests to w as JSON lines, instead of making RPC calls.
+// Metric descriptors created through it are remembered, so that they can be fetched later.
+type dryRunClient struct {
+	// mu protects all fields.
+	mu sync.Mutex
+	w  io.Writer
+	// closer closes w. It is nil when w is given by users.
+	closer io.Closer
+	// descs holds created metric descriptors, keyed by their resource names.
+	descs map[string]*metricpb.MetricDescriptor
+}
+
+// newDryRunClient creates dryRunClient writing to DryRunWriter, or to DryRunFile when
+// DryRunWriter is not set.
+func newDryRunClient(opts *Options) (*dryRunClient, error) {
+	cl := &dryRunClient{
+		w:     opts.DryRunWriter,
+		descs: make(map[string]*metricpb.MetricDescriptor),
+	}
+	if cl.w == nil {
+		f, err := os.OpenFile(opts.DryRunFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		cl.w, cl.closer = f, f
+	}
+	return cl, nil
+}
+
+func (cl *dryRunClient) CreateTimeSeries(_ context.Context, req *monitoringpb.CreateTimeSeriesRequest, _ ...gax.CallOption) error {
+	rec := &dryRunRecord{
+		Method:      "CreateTimeSeries",
+		Project:     strings.TrimPrefix(req.Name, "projects/"),
+		SeriesCount: len(req.TimeSeries),
+	}
+	var start, end time.Time
+	for _, ts := range req.TimeSeries {
+		for _, point := range ts.Points {
+			if t, err := ptypes.Timestamp(point.Interval.GetStartTime()); err == nil && (start.IsZero() || t.Before(start)) {
+				start = t
+			}
+			if t, err := ptypes.Timestamp(point.Interval.GetEndTime()); err == nil && end.Before(t) {
+				end = t
+			}
+		}
+	}
+	if !start.IsZero() {
+		rec.StartTime = start.UTC().Format(time.RFC3339Nano)
+	}
+	if !end.IsZero() {
+		rec.EndTime = end.UTC().Format(time.RFC3339Nano)
+	}
+	return cl.write(rec, req)
+}
+
+func (cl *dryRunClient) CreateMetricDescriptor(_ context.Context, req *monitoringpb.CreateMetricDescriptorRequest, _ ...gax.CallOption) (*metricpb.MetricDescriptor, error) {
+	rec := &dryRunRecord{
+		Method:  "CreateMetricDescriptor",
+		Project: strings.TrimPrefix(req.Name, "projects/"),
+	}
+	if err := cl.write(rec, req); err != nil {
+		return nil, err
+	}
+	desc := req.MetricDescriptor
+	name := fmt.Sprintf("%s/metricDescriptors/%s", req.Name, desc.Type)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if _, ok := cl.descs[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "metric descriptor %s already exists", name)
+	}
+	cl.descs[name] = desc
+	return desc, nil
+}
+
+func (cl *dryRunClient) GetMetricDescriptor(_ context.Context, req *monitoringpb.GetMetricDescriptorRequest, _ ...gax.CallOption) (*metricpb.MetricDescriptor, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	desc, ok := cl.descs[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "metric descriptor %s is not created in dry run", req.Name)
+	}
+	return desc, nil
+}
+
+func (cl *dryRunClient) Close() error {
+	if cl.closer == nil {
+		return nil
+	}
+	return cl.closer.Close()
+}
+
+// write writes rec with req as a line.
+func (cl *dryRunClient) write(rec *dryRunRecord, req proto.Message) error {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, req); err != nil {
+		return fmt.Errorf("failed to marshal request in dry run: %v", err)
+	}
+	rec.Request = buf.Bytes()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request in dry run: %v", err)
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if _, err := cl.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write request in dry run: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	timestamppb "github.com/golang/protobuf/ptypes/timestamp"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// decorateDistribution adds range and exemplars of data to dist as designated by options. dist must
+// be converted from data by newTypedValue().
+func (pd *projectData) decorateDistribution(dist *distributionpb.Distribution, data *view.DistributionData) {
+	opts := pd.parent.opts
+	// Min and max are meaningless for empty distribution.
+	if opts.ExportDistributionRange && 0 < data.Count {
+		dist.Range = &distributionpb.Distribution_Range{
+			Min: data.Min,
+			Max: data.Max,
+		}
+	}
+	if opts.ExportExemplars {
+		for _, exemplar := range data.ExemplarsPerBucket {
+			// Buckets without any exemplar have nil.
+			if exemplar == nil {
+				continue
+			}
+			dist.Exemplars = append(dist.Exemplars, pd.newExemplar(exemplar))
+		}
+	}
+}
+
+// newExemplar converts opencensus exemplar to stackdriver exemplar.
+func (pd *projectData) newExemplar(exemplar *metricdata.Exemplar) *distributionpb.Distribution_Exemplar {
+	return &distributionpb.Distribution_Exemplar{
+		Value: exemplar.Value,
+		Timestamp: &timestamppb.Timestamp{
+			Seconds: exemplar.Timestamp.Unix(),
+			Nanos:   int32(exemplar.Timestamp.Nanosecond()),
+		},
+		Attachments: pd.newAttachments(exemplar.Attachments),
+	}
+}
+
+// newAttachments converts attachments of opencensus exemplar to those of stackdriver exemplar. Span
+// context becomes SpanContext referring the span in the project, so that stackdriver can link the
+// exemplar to the trace. All other attachments are put together into DroppedLabels with their
+// string representation.
+func (pd *projectData) newAttachments(attachments metricdata.Attachments) []*anypb.Any {
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	var msgs []proto.Message
+	droppedLabels := map[string]string{}
+	for key, value := range attachments {
+		if spanCtx, ok := value.(trace.SpanContext); ok && key == metricdata.AttachmentKeySpanContext {
+			msgs = append(msgs, &monitoringpb.SpanContext{
+				SpanName: fmt.Sprintf("projects/%s/traces/%s/spans/%s", pd.projectID, spanCtx.TraceID, spanCtx.SpanID),
+			})
+			continue
+		}
+		droppedLabels[key] = fmt.Sprint(value)
+	}
+	if len(droppedLabels) != 0 {
+		msgs = append(msgs, &monitoringpb.DroppedLabels{Label: droppedLabels})
+	}
+
+	var anys []*anypb.Any
+	for _, msg := range msgs {
+		// Both message types are registered protobuf messages, so marshalling never fails.
+		if any, err := ptypes.MarshalAny(msg); err == nil {
+			anys = append(anys, any)
+		}
+	}
+	return anys
+}
@@ -6,30 +6,37 @@
 // 2. We can inspect each RowData to tell whether this RowData is applicable for this exporter.
 // 3. For RowData that is applicable to this exporter, we require that
 // 3.1. Any view associated to RowData corresponds to a stackdriver metric, and it is already
-//      defined for all GCP projects.
+//      defined for all GCP projects. (When Options.CreateMetricDescriptors is set, the exporter
+//      creates the metric from the view instead.)
 // 3.2. RowData has correcponding GCP projects, and we can determine its project ID.
 // 3.3. After trimming labels and tags, configuration of all view data matches that of corresponding
-//      stackdriver metric
+//      stackdriver metric (Options.ValidateRowData makes the exporter check this.)
 package exporter
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	monitoring "cloud.google.com/go/monitoring/apiv3"
 	gax "github.com/googleapis/gax-go"
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"go.opencensus.io/metric/metricdata"
 	"go.opencensus.io/stats/view"
 	"google.golang.org/api/option"
-	"google.golang.org/api/support/bundler"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
-// StatsExporter is the exporter that can be registered to opencensus. A StatsExporter object must
-// be created by NewStatsExporter().
+// StatsExporter is the exporter that can be registered to opencensus. It exports both view data of
+// stats API and metrics of metric API. A StatsExporter object must be created by
+// NewStatsExporter().
 type StatsExporter struct {
 	ctx    context.Context
 	client metricClient
@@ -39,11 +46,46 @@ type StatsExporter struct {
 	getProjectID func(*RowData) (string, error)
 	onError      func(error, ...*RowData)
 	makeResource func(*RowData) (*monitoredrespb.MonitoredResource, error)
+	onWarning    func(*Warning)
+	onSpoolError func(error, string, []*monitoringpb.TimeSeries)
 
 	// mu protects access to projDataMap
 	mu sync.Mutex
 	// per-project data of exporter
 	projDataMap map[string]*projectData
+
+	// metricViewMu protects metricViews, which caches views describing metrics exported by
+	// ExportMetrics(), keyed by metric names.
+	metricViewMu sync.Mutex
+	metricViews  map[string]*cachedMetricView
+	// metricSourceMu protects metricSources, which keeps time series of metric API that row data
+	// made by ExportMetrics() are made from, until the row data are uploaded or dropped.
+	metricSourceMu sync.Mutex
+	metricSources  map[*RowData]*metricSource
+
+	// labelMu protects labelKeyMaps, which caches maps from original label keys to sanitized
+	// label keys per view, and unknownLabels, which has keys of labels not from the view already
+	// reported per view.
+	labelMu       sync.Mutex
+	labelKeyMaps  map[*view.View]map[string]string
+	unknownLabels map[*view.View]map[string]bool
+
+	// clientMu protects clients, which caches metric clients made from ClientOptionsForProject,
+	// keyed by credentials IDs, or by projects without them. Clients are closed when no project
+	// data use them.
+	clientMu sync.Mutex
+	clients  map[clientKey]*sharedClient
+
+	// spool persists requests that could not be uploaded. It is nil when SpoolDir option is
+	// not set.
+	spool *spool
+
+	// done is closed when the exporter is closed, to stop background goroutines. wg waits for
+	// background goroutines to stop. shutdownOnce makes sure that the exporter is shut down only
+	// once.
+	done         chan struct{}
+	wg           sync.WaitGroup
+	shutdownOnce sync.Once
 }
 
 // Options designates various parameters used by stats exporter. Default value of fields in Options
@@ -52,11 +94,96 @@ type Options struct {
 	// ClientOptions designates options for creating metric client, especially credentials for
 	// RPC calls.
 	ClientOptions []option.ClientOption
+	// ClientOptionsForProject designates client options for each project, like credentials of a
+	// service account in the project. A client is created lazily and closed with the exporter.
+	// Projects returning the same non-empty credentialsID share the client made from options
+	// of the first of them, and a project returning empty credentialsID has its own client.
+	// When it returns empty options, or when it's not set, the client made from ClientOptions
+	// is used. Errors from it or from creating the client are reported via OnError with the
+	// row data of the project.
+	ClientOptionsForProject func(projectID string) (credentialsID string, opts []option.ClientOption, err error)
 
 	// options for bundles amortizing export requests. Note that a bundle is created for each
-	// project. When not provided, default values in bundle package are used.
-	BundleDelayThreshold time.Duration
-	BundleCountThreshold int
+	// project. BundleHandlerLimit limits concurrent uploads per project, and
+	// BundleBufferedByteLimit limits estimated size of row data waiting for upload per project.
+	// When not provided, default values in bundle package are used.
+	BundleDelayThreshold    time.Duration
+	BundleCountThreshold    int
+	BundleByteThreshold     int
+	BundleHandlerLimit      int
+	BundleBufferedByteLimit int
+
+	// OverflowPolicy designates what to do with row data when BundleBufferedByteLimit of its
+	// project is reached, and OverflowTimeout limits the time that row data waits for room in
+	// the bundle with OverflowDropNextBundle and OverflowBlock policies. Zero OverflowTimeout means
+	// default value, 5 seconds, so that exporting never blocks without limit. Dropped row data
+	// are reported via OnError.
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+
+	// ProjectIdleTTL designates how long per-project data of exporter, including the bundle, is
+	// kept without any row data exported to the project. Idle projects are flushed and removed
+	// from the exporter, and they are created again when new row data for them arrives. When
+	// ProjectIdleTTL is not set, per-project data are kept until the exporter is closed, unless
+	// ForgetProject() is called.
+	ProjectIdleTTL time.Duration
+
+	// options for retrying failed RPC calls to create time series. Only errors with retryable
+	// gRPC codes (UNAVAILABLE, DEADLINE_EXCEEDED and ABORTED) are retried, and OnError is
+	// called only after the exporter gives up on retrying. Backoff between attempts grows
+	// exponentially from RetryInitialBackoff up to RetryMaxBackoff, and the actual wait time
+	// is randomly jittered within the backoff. RetryTimeout limits total time spent on a
+	// request including all attempts. When RetryMaxAttempts is not larger than 1, failed RPC
+	// calls are not retried at all. Zero values of other fields mean default values.
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryTimeout        time.Duration
+
+	// options for spooling requests that could not be uploaded. When SpoolDir is set, requests
+	// whose RPC calls failed with retryable errors even after retries are persisted in a
+	// subdirectory of SpoolDir per project, instead of being reported via OnError. Spooled
+	// requests are replayed in order by a background goroutine when the exporter starts, and
+	// before any other request of the project is uploaded, since stackdriver rejects points
+	// older than the last point of their series. While spooled requests of a project can't be
+	// replayed, further requests of the project are spooled after them. Replayed requests are
+	// uploaded with retries and rate limits of the project like any other requests. Time series
+	// whose points are older than 25 hours are not accepted by stackdriver, so they are dropped
+	// when replaying. SpoolMaxAge and SpoolMaxBytes limit age and total size of spooled
+	// requests, and oldest requests are dropped when the limits are exceeded. Zero values of the
+	// limits mean default values, 25 hours and 64MiB. Dropped requests are reported via
+	// OnSpoolError. Project IDs name subdirectories of SpoolDir, so requests of project IDs not
+	// in the form of GCP project IDs are reported via OnError instead of being spooled.
+	SpoolDir      string
+	SpoolMaxAge   time.Duration
+	SpoolMaxBytes int64
+
+	// options for dry run. When DryRunWriter or DryRunFile is set, the exporter doesn't make any
+	// RPC calls to stackdriver. Instead, each request is written to DryRunWriter, or to
+	// DryRunFile when DryRunWriter is not set, as a JSON line with the method, the project ID,
+	// and the request itself. Lines of requests to create time series also have the number of
+	// time series and the time range of their points. Bundling and splitting of requests are
+	// same as usual, so outputs can be compared between releases. Metric descriptors created in
+	// dry run are remembered for ValidateRowData option, and others are considered missing.
+	// ClientOptions and ClientOptionsForProject are ignored in dry run. DryRunFile is truncated
+	// when the exporter is created, and closed when the exporter is closed.
+	DryRunWriter io.Writer
+	DryRunFile   string
+
+	// Sink replaces stackdriver as the destination of time series. When Sink is set, the
+	// exporter makes time series with its routing, labeling, bundling and rate limits as usual,
+	// and passes them to Sink instead of making RPC calls. Errors from Sink are reported via
+	// OnError without retries. Options only meaningful with stackdriver, which are client
+	// options, retries, spooling, dry run and options concerning metric descriptors, are ignored.
+	Sink Sink
+
+	// options for rate limiting uploads to each project, protecting write quotas of projects
+	// from chatty tenants. RateLimit applies to all projects, and ProjectRateLimits overrides it
+	// for projects in its keys. nil value in ProjectRateLimits removes the limit of the project.
+	// Requests exceeding the limits are delayed or dropped by Policy of the limit, and both are
+	// recorded in observability subpackage. When none is set, uploads are not limited.
+	RateLimit         *RateLimit
+	ProjectRateLimits map[string]*RateLimit
 
 	// callback functions provided by user.
 
@@ -73,12 +200,35 @@ type Options struct {
 	// OnError. Row data passed to OnError must not be modified. When OnError is not set, all
 	// errors happened on exporting are ignored.
 	OnError func(error, ...*RowData)
+	// OnSpoolError is used to report errors on requests spooled by SpoolDir option, whose row
+	// data are no longer available. timeSeries are those dropped from spooled requests of the
+	// project, and they are nil when the error doesn't drop any, or when the spooled request
+	// can't be read. timeSeries must not be modified. When OnSpoolError is not set, these errors
+	// are ignored.
+	OnSpoolError func(err error, projectID string, timeSeries []*monitoringpb.TimeSeries)
+	// GetMetricProjectID and MakeMetricResource are counterparts of GetProjectID and
+	// MakeResource for time series of metrics exported by ExportMetrics(), and they are given
+	// the metric and the time series that row data is made from. When GetMetricProjectID is not
+	// set, GetProjectID is used. When MakeMetricResource is not set, resource of the metric is
+	// used if it has a type, and MakeResource is used otherwise.
+	GetMetricProjectID func(*metricdata.Metric, *metricdata.TimeSeries) (projectID string, err error)
+	MakeMetricResource func(*metricdata.Metric, *metricdata.TimeSeries) (*monitoredrespb.MonitoredResource, error)
 	// MakeResource creates monitored resource from RowData. It is guaranteed that only RowData
 	// that passes GetProjectID will be given to this function. Though not recommended, error
 	// can be returned, and in that case the error is reported to callers via OnError and the
 	// row data will not be uploaded to stackdriver. When MakeResource is not set, global
 	// resource is used for all RowData objects.
 	MakeResource func(rd *RowData) (*monitoredrespb.MonitoredResource, error)
+	// OnWarning is used to report changes that the exporter made on data being exported, like
+	// sanitizing labels. Unlike OnError, data are still exported. When OnWarning is not set,
+	// warnings are ignored.
+	OnWarning func(*Warning)
+
+	// ExportSelfObservability makes the exporter export observability data of the exporter
+	// itself, which are defined in observability subpackage, like any other data. By default,
+	// the exporter ignores them to avoid exporting its own metrics to tenant projects
+	// recursively.
+	ExportSelfObservability bool
 
 	// options concerning labels.
 
@@ -92,6 +242,82 @@ type Options struct {
 	// uses of unexported labels will be either that marks project ID, or that's used only for
 	// constructing resource.
 	UnexportedLabels []string
+	// options for sanitizing labels. When SanitizeLabels is set, labels violating limits of
+	// stackdriver are fixed instead of failing RPC calls of whole requests: label keys are
+	// rewritten to consist of letters, digits and underscores and to start with a letter within
+	// 100 characters, label values longer than 1024 bytes are truncated with
+	// LabelValueTruncationSuffix, and labels over MaxLabelsPerMetric of a view are dropped.
+	// Labels whose rewritten keys collide with those of other labels are also dropped. Labels of
+	// a view are processed in the order of their keys, except that labels with valid keys come
+	// first, so that they are kept on collisions. Each change is reported via OnWarning, but
+	// changes of label keys, including labels not from the view, are reported only once per
+	// view. Zero value of MaxLabelsPerMetric means default value, 30.
+	SanitizeLabels             bool
+	LabelValueTruncationSuffix string
+	MaxLabelsPerMetric         int
+
+	// options concerning metric types. Metric types made by these options are validated before
+	// uploading, and row data with invalid metric types are reported via OnError.
+
+	// MetricPrefix is prepended to view names to make stackdriver metric types, like
+	// "custom.googleapis.com/opencensus". A slash is inserted between the prefix and the view
+	// name unless the prefix ends with a slash. When neither MetricPrefix nor MetricTypeFunc is
+	// set, view names are used as metric types as they are.
+	MetricPrefix string
+	// MetricTypeFunc returns stackdriver metric type of row data for given project. When set,
+	// MetricPrefix is ignored. It allows mapping a view to different metric types per project.
+	MetricTypeFunc func(rd *RowData, projectID string) string
+
+	// options concerning distributions.
+
+	// ExportDistributionRange makes the exporter fill range of distributions with min and max of
+	// distribution data.
+	ExportDistributionRange bool
+	// ExportExemplars makes the exporter attach exemplars of distribution data to distributions.
+	// Span context in exemplar attachments is converted to a reference to the span in the same
+	// project of the row data, so that the exemplar is linked to the trace. Other attachments
+	// are exported as dropped labels.
+	ExportExemplars bool
+
+	// options concerning cumulative metrics. When TrackCumulative is set, the exporter keeps the
+	// last exported point of each cumulative time series per project, and checks new points
+	// against it. When a series is reset, which is detected by decreasing value or start time
+	// moving forward, start time of the point is adjusted if necessary so that intervals of the
+	// series never overlap. For distributions, decrease of the count, any bucket count or the sum
+	// is a reset. Points not later than the last point are dropped. These are reported via
+	// OnWarning. Points are tracked only after they are exported successfully, and a request has
+	// at most one point of a tracked series. Concurrent uploads of a project convert points of a
+	// series one at a time, so a point uploaded after a later point of its series is dropped.
+	// MaxTrackedSeries limits the number of tracked series per project, and least recently
+	// exported series are forgotten first. Zero value of MaxTrackedSeries means default value,
+	// 10000.
+	TrackCumulative  bool
+	MaxTrackedSeries int
+	// MetricKinds overrides metric kinds of views, keyed by view names. Cumulative data of views
+	// are converted to DELTA, the difference from the last exported point of the series, or to
+	// GAUGE, the current value. The first point of a DELTA series is not exported, but kept as
+	// the base of the next point, and recorded with "delta_base" outcome of observability. The
+	// whole value is exported after a reset. When a DELTA point is not exported, for example by
+	// rate limits or failed uploads, the next point covers its interval, so DELTA points are
+	// never spooled. Ranges of distributions are not exported for DELTA. Series are tracked as by TrackCumulative, and
+	// bounded by MaxTrackedSeries. Last value views are always GAUGE.
+	MetricKinds map[string]metricpb.MetricDescriptor_MetricKind
+
+	// options concerning metric descriptors.
+
+	// CreateMetricDescriptors makes the exporter create the metric descriptor of a view in a
+	// project when the view is first seen for the project, instead of requiring the metric to
+	// be defined beforehand. Metric kind, value type, unit, description and labels of the
+	// metric are derived from the view, DefaultLabels and UnexportedLabels. Failure of creating
+	// a metric descriptor is reported via OnError with the row data of the view, and creation
+	// is tried again when next row data of the view arrives.
+	CreateMetricDescriptors bool
+	// ValidateRowData makes the exporter check metric kind, value type and labels of each row
+	// data against the metric descriptor of its project before uploading. Metric descriptors
+	// are fetched once per project and view, and cached. Row data that doesn't match is
+	// reported via OnError with MetricMismatchError, and is not uploaded. Without validation,
+	// a mismatching row data fails the whole RPC call with other row data uploaded together.
+	ValidateRowData bool
 }
 
 // default values for options
@@ -101,6 +327,8 @@ func defaultGetProjectID(rd *RowData) (string, error) {
 
 func defaultOnError(err error, rds ...*RowData) {}
 
+func defaultOnSpoolError(err error, projectID string, timeSeries []*monitoringpb.TimeSeries) {}
+
 func defaultMakeResource(rd *RowData) (*monitoredrespb.MonitoredResource, error) {
 	return &monitoredrespb.MonitoredResource{Type: "global"}, nil
 }
@@ -109,16 +337,32 @@ func defaultMakeResource(rd *RowData) (*monitoredrespb.MonitoredResource, error)
 // fields in opts must not be modified at all. ctx will also be used throughout entire exporter
 // operation when making RPC call.
 func NewStatsExporter(ctx context.Context, opts *Options) (*StatsExporter, error) {
-	client, err := newMetricClient(ctx, opts.ClientOptions...)
-	if err != nil {
+	if err := checkMetricKinds(opts.MetricKinds); err != nil {
+		return nil, err
+	}
+	var client metricClient
+	var err error
+	if opts.Sink != nil {
+		client = sinkClient{}
+	} else if opts.DryRunWriter != nil || opts.DryRunFile != "" {
+		if client, err = newDryRunClient(opts); err != nil {
+			return nil, fmt.Errorf("failed to open dry run file %s: %v", opts.DryRunFile, err)
+		}
+	} else if client, err = newMetricClient(ctx, opts.ClientOptions...); err != nil {
 		return nil, fmt.Errorf("failed to create a metric client: %v", err)
 	}
 
 	e := &StatsExporter{
-		ctx:         ctx,
-		client:      client,
-		opts:        opts,
-		projDataMap: make(map[string]*projectData),
+		ctx:           ctx,
+		client:        client,
+		opts:          opts,
+		projDataMap:   make(map[string]*projectData),
+		metricViews:   make(map[string]*cachedMetricView),
+		metricSources: make(map[*RowData]*metricSource),
+		labelKeyMaps:  make(map[*view.View]map[string]string),
+		unknownLabels: make(map[*view.View]map[string]bool),
+		clients:       make(map[clientKey]*sharedClient),
+		done:          make(chan struct{}),
 	}
 
 	// We don't want to modify user-supplied options, so save default options directly in
@@ -138,6 +382,27 @@ func NewStatsExporter(ctx context.Context, opts *Options) (*StatsExporter, error
 	} else {
 		e.makeResource = defaultMakeResource
 	}
+	if opts.OnWarning != nil {
+		e.onWarning = opts.OnWarning
+	} else {
+		e.onWarning = defaultOnWarning
+	}
+	if opts.OnSpoolError != nil {
+		e.onSpoolError = opts.OnSpoolError
+	} else {
+		e.onSpoolError = defaultOnSpoolError
+	}
+
+	if opts.SpoolDir != "" && opts.Sink == nil {
+		e.spool = newSpool(e)
+		if err := e.spool.start(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to start spool in %s: %v", opts.SpoolDir, err)
+		}
+	}
+	if 0 < opts.ProjectIdleTTL {
+		e.startEvictingIdleProjects()
+	}
 
 	return e, nil
 }
@@ -145,6 +410,8 @@ func NewStatsExporter(ctx context.Context, opts *Options) (*StatsExporter, error
 // We wrap monitoring.MetricClient and it's maker for testing.
 type metricClient interface {
 	CreateTimeSeries(context.Context, *monitoringpb.CreateTimeSeriesRequest, ...gax.CallOption) error
+	CreateMetricDescriptor(context.Context, *monitoringpb.CreateMetricDescriptorRequest, ...gax.CallOption) (*metricpb.MetricDescriptor, error)
+	GetMetricDescriptor(context.Context, *monitoringpb.GetMetricDescriptorRequest, ...gax.CallOption) (*metricpb.MetricDescriptor, error)
 	Close() error
 }
 
@@ -181,52 +448,227 @@ func (e *StatsExporter) ExportView(vd *view.Data) {
 // See GetProjectID of Options for more detail.
 var RowDataNotApplicableError = errors.New("row data is not applicable to the exporter, so it will be ignored")
 
-// exportRowData exports a single row data.
-func (e *StatsExporter) exportRowData(rd *RowData) {
-	projID, err := e.getProjectID(rd)
-	if err != nil {
-		// We ignore non-applicable RowData.
-		if err != RowDataNotApplicableError {
-			newErr := fmt.Errorf("failed to get project ID on row data with view %s: %v", rd.View.Name, err)
-			e.onError(newErr, rd)
-		}
-		return
+// exportRowData exports a single row data. It returns false when rd is not added to a bundle.
+func (e *StatsExporter) exportRowData(rd *RowData) bool {
+	projID, ok := e.routeRowData(rd)
+	if !ok {
+		return false
 	}
 	pd := e.getProjectData(projID)
-	switch err := pd.bndler.Add(rd, 1); err {
+	err := pd.addRowData(rd)
+	for err == errProjectDataStopped {
+		// The project is forgotten meanwhile, so rd goes to project data created again.
+		pd = e.getProjectData(projID)
+		err = pd.addRowData(rd)
+	}
+	switch err {
 	case nil:
-	case bundler.ErrOversizedItem:
-		go pd.uploadRowData(rd)
+		observability.RecordRows(e.ctx, projID, observability.OutcomeAccepted, 1)
+		return true
 	default:
 		newErr := fmt.Errorf("failed to add row data with view %s to bundle for project %s: %v", rd.View.Name, projID, err)
 		e.onError(newErr, rd)
+		observability.RecordRows(e.ctx, projID, observability.OutcomeDropped, 1)
+		observability.RecordBundlerOverflow(e.ctx, projID)
+		return false
+	}
+}
+
+// routeRowData returns project ID of rd. It returns false when rd is not exported, after reporting
+// the reason if necessary.
+func (e *StatsExporter) routeRowData(rd *RowData) (string, bool) {
+	// We don't export observability data of the exporter itself unless asked to.
+	if !e.opts.ExportSelfObservability && observability.IsExporterView(rd.View) {
+		return "", false
+	}
+	projID, err := e.projectIDOf(rd)
+	if err != nil {
+		// We ignore non-applicable RowData.
+		if err != RowDataNotApplicableError {
+			newErr := fmt.Errorf("failed to get project ID on row data with view %s: %v", rd.View.Name, err)
+			e.onError(newErr, rd)
+			observability.RecordRows(e.ctx, "", observability.OutcomeProjectIDError, 1)
+		} else {
+			observability.RecordRows(e.ctx, "", observability.OutcomeNotApplicable, 1)
+		}
+		return "", false
 	}
+	return projID, true
 }
 
 func (e *StatsExporter) getProjectData(projectID string) *projectData {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	if pd, ok := e.projDataMap[projectID]; ok {
-		return pd
+	pd, ok := e.projDataMap[projectID]
+	if !ok {
+		pd = e.newProjectData(projectID)
+		e.projDataMap[projectID] = pd
 	}
-
-	pd := e.newProjectData(projectID)
-	e.projDataMap[projectID] = pd
+	pd.lastUsed = time.Now()
 	return pd
 }
 
-// Close flushes and closes the exporter. Close must be called after the exporter is unregistered
-// and no further calls to ExportView() are made. Once Close() is returned no further access to the
-// exporter is allowed in any way.
-func (e *StatsExporter) Close() error {
+// ForgetProject removes per-project data of the project from the exporter, and stops its bundler
+// after flushing row data in it. The metric client made for the project from
+// ClientOptionsForProject is closed, unless it's shared with other projects. Row data exported to the project concurrently with ForgetProject
+// or afterwards create per-project data again.
+func (e *StatsExporter) ForgetProject(projectID string) {
+	e.mu.Lock()
+	pd, ok := e.projDataMap[projectID]
+	delete(e.projDataMap, projectID)
+	e.mu.Unlock()
+
+	// Stop outside of the lock, since flushing may take long.
+	if ok {
+		pd.stop()
+	}
+}
+
+// evictIdleProjects forgets all projects that have been idle longer than ProjectIdleTTL at given
+// time.
+func (e *StatsExporter) evictIdleProjects(now time.Time) {
+	var idlePds []*projectData
+	e.mu.Lock()
+	for projectID, pd := range e.projDataMap {
+		if e.opts.ProjectIdleTTL < now.Sub(pd.lastUsed) {
+			idlePds = append(idlePds, pd)
+			delete(e.projDataMap, projectID)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, pd := range idlePds {
+		pd.stop()
+	}
+}
+
+// startEvictingIdleProjects starts the goroutine periodically evicting idle projects. The
+// goroutine stops when the exporter is closed.
+func (e *StatsExporter) startEvictingIdleProjects() {
+	// Checking idle projects twice in TTL is precise enough.
+	interval := e.opts.ProjectIdleTTL / 2
+	if interval <= 0 {
+		interval = e.opts.ProjectIdleTTL
+	}
+	ticker := time.NewTicker(interval)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				e.evictIdleProjects(now)
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// FlushError is returned by Flush() and Shutdown() when the context is done before all uploads are
+// finished.
+type FlushError struct {
+	// Err is the error of the context.
+	Err error
+	// PendingProjects are the IDs of projects whose uploads were not finished, in sorted order.
+	PendingProjects []string
+	// OversizedUploads is the number of unfinished uploads of row data too large to be bundled.
+	OversizedUploads int
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("flush is not finished before %v: uploads pending for projects %s, including %d uploads of oversized row data", e.Err, strings.Join(e.PendingProjects, ", "), e.OversizedUploads)
+}
+
+// Flush uploads all row data exported so far, and waits until the uploads are finished, including
+// retries and uploads of row data too large to be bundled. Projects are flushed in parallel. When
+// ctx is done before that, Flush returns *FlushError listing projects with pending uploads, which
+// go on in background.
+func (e *StatsExporter) Flush(ctx context.Context) error {
 	e.mu.Lock()
+	pds := make([]*projectData, 0, len(e.projDataMap))
 	for _, pd := range e.projDataMap {
-		pd.bndler.Flush()
+		pds = append(pds, pd)
 	}
 	e.mu.Unlock()
 
-	if err := e.client.Close(); err != nil {
-		return fmt.Errorf("failed to close the metric client: %v", err)
+	dones := make([]chan struct{}, len(pds))
+	for i, pd := range pds {
+		done := make(chan struct{})
+		dones[i] = done
+		go func(pd *projectData) {
+			defer close(done)
+			pd.flush()
+		}(pd)
+	}
+
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return newFlushError(ctx.Err(), pds, dones)
+		}
 	}
 	return nil
 }
+
+// newFlushError makes FlushError from projects whose flushes are not done yet.
+func newFlushError(ctxErr error, pds []*projectData, dones []chan struct{}) *FlushError {
+	flushErr := &FlushError{Err: ctxErr}
+	for i, pd := range pds {
+		select {
+		case <-dones[i]:
+			continue
+		default:
+		}
+		flushErr.PendingProjects = append(flushErr.PendingProjects, pd.projectID)
+		flushErr.OversizedUploads += pd.pendingOversized()
+	}
+	sort.Strings(flushErr.PendingProjects)
+	return flushErr
+}
+
+// Shutdown flushes the exporter like Flush(), stops background goroutines of the exporter and closes
+// the metric client. Shutdown must be called after the exporter is unregistered and no further
+// calls to ExportView() or ExportMetrics() are made. When ctx is done before the flush is finished,
+// pending uploads are abandoned and fail as the client is closed, and *FlushError is returned.
+// Calls after the first one do nothing but returning nil. Once Shutdown() is returned no further
+// access to the exporter is allowed in any way, except for calling Shutdown() or Close() again.
+func (e *StatsExporter) Shutdown(ctx context.Context) error {
+	var err error
+	e.shutdownOnce.Do(func() {
+		err = e.shutdown(ctx)
+	})
+	return err
+}
+
+func (e *StatsExporter) shutdown(ctx context.Context) error {
+	err := e.Flush(ctx)
+
+	// Stop background goroutines.
+	close(e.done)
+	stopped := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		if err == nil {
+			err = fmt.Errorf("background goroutines of the exporter are not stopped before %v", ctx.Err())
+		}
+	}
+
+	if closeErr := e.closeClients(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to close the metric client: %v", closeErr)
+	}
+	return err
+}
+
+// Close flushes and closes the exporter, waiting for all uploads to finish. It is same as
+// Shutdown() without deadline.
+func (e *StatsExporter) Close() error {
+	return e.Shutdown(context.Background())
+}
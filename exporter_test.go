@@ -1,11 +1,41 @@
 package exporter
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"go.opencensus.io/metric/metricdata"
+	ocresource "go.opencensus.io/resource"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/attribute"
+	otelmetricdata "go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/api/option"
+	"google.golang.org/api/support/bundler"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // This file contains actual tests.
@@ -104,6 +134,580 @@ func TestProjectClassifyError(t *testing.T) {
 	checkExpProjData(t, exp, wantRowData)
 }
 
+// TestSelfObservabilityIgnored tests that exporter does not export its own observability data unless
+// asked to.
+func TestSelfObservabilityIgnored(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) {
+		return project1, nil
+	}
+	selfData := &view.Data{
+		View:  observability.RowsView,
+		Start: startTime1,
+		End:   endTime1,
+		Rows:  []*view.Row{view1row1},
+	}
+
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID})
+	exp.ExportView(selfData)
+	checkErrStorage(t, errStore, nil)
+	checkExpProjData(t, exp, nil)
+
+	exp, errStore = newMockExp(t, &Options{GetProjectID: getProjectID, ExportSelfObservability: true})
+	exp.ExportView(selfData)
+	checkErrStorage(t, errStore, nil)
+	checkExpProjData(t, exp, map[string][]*RowData{
+		project1: []*RowData{{observability.RowsView, startTime1, endTime1, view1row1}},
+	})
+}
+
+// TestExportMetrics tests that exporter converts points of metrics to RowData, and distributes them
+// by their projects.
+func TestExportMetrics(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) {
+		return project1, nil
+	}
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID})
+	metrics := []*metricdata.Metric{
+		{
+			Descriptor: metricdata.Descriptor{
+				Name:      metric1name,
+				Unit:      metricdata.UnitDimensionless,
+				Type:      metricdata.TypeCumulativeInt64,
+				LabelKeys: []metricdata.LabelKey{{Key: label1name}},
+			},
+			TimeSeries: []*metricdata.TimeSeries{
+				{
+					LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue(value1)},
+					Points:      []metricdata.Point{metricdata.NewInt64Point(endTime1, 7)},
+					StartTime:   startTime1,
+				},
+			},
+		}, {
+			Descriptor: metricdata.Descriptor{
+				Name: metric2name,
+				Type: metricdata.TypeSummary,
+			},
+			TimeSeries: []*metricdata.TimeSeries{
+				{
+					Points:    []metricdata.Point{metricdata.NewSummaryPoint(endTime2, &metricdata.Summary{})},
+					StartTime: startTime2,
+				},
+			},
+		},
+	}
+	if err := exp.ExportMetrics(ctx, metrics); err != nil {
+		t.Fatalf("exporting metrics failed: %v", err)
+	}
+
+	if len(errStore.errRds) != 1 {
+		t.Fatalf("number of reported errors got: %d, want: 1", len(errStore.errRds))
+	}
+	wantErrPrefix := "failed to convert point of metric " + metric2name + " for project " + project1 + ": unsupported metric type"
+	if errStr := errStore.errRds[0].err.Error(); !strings.HasPrefix(errStr, wantErrPrefix) {
+		t.Errorf("error got: %q, want: prefixed by %q", errStr, wantErrPrefix)
+	}
+
+	rds := exp.projDataMap[project1].bndler.(*mockBundler).rowDataArr
+	if len(rds) != 1 {
+		t.Fatalf("number of row data got: %d, want: 1", len(rds))
+	}
+	rd := rds[0]
+	if rd.View.Name != metric1name || rd.View.Aggregation.Type != view.AggTypeSum {
+		t.Errorf("view got: %s with aggregation %v, want: %s with sum", rd.View.Name, rd.View.Aggregation.Type, metric1name)
+	}
+	if rd.Start != startTime1 || rd.End != endTime1 {
+		t.Errorf("time got: [%v, %v], want: [%v, %v]", rd.Start, rd.End, startTime1, endTime1)
+	}
+	if data, ok := rd.Row.Data.(*view.SumData); !ok || data.Value != 7 {
+		t.Errorf("data got: %#v, want: sum of 7", rd.Row.Data)
+	}
+	if len(rd.Row.Tags) != 1 || rd.Row.Tags[0].Key.Name() != label1name || rd.Row.Tags[0].Value != value1 {
+		t.Errorf("tags got: %v, want: %s=%s", rd.Row.Tags, label1name, value1)
+	}
+}
+
+// TestExportMetricsRouting tests that metricdata-aware callbacks and resources of metrics are used
+// for metrics, that unsupported metrics not applicable to the exporter are not reported, and that
+// int64 values are exported exactly.
+func TestExportMetricsRouting(t *testing.T) {
+	getMetricProjectID := func(metric *metricdata.Metric, ts *metricdata.TimeSeries) (string, error) {
+		if ts.LabelValues[0].Value == value1 {
+			return project2, nil
+		}
+		return "", RowDataNotApplicableError
+	}
+	exp, errStore := newMockExp(t, &Options{GetMetricProjectID: getMetricProjectID})
+	const bigValue = int64(1)<<53 + 1
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{
+			Name:      metric1name,
+			Type:      metricdata.TypeCumulativeInt64,
+			LabelKeys: []metricdata.LabelKey{{Key: label1name}},
+		},
+		Resource: &ocresource.Resource{
+			Type:   resource2.Type,
+			Labels: resource2.Labels,
+		},
+		TimeSeries: []*metricdata.TimeSeries{
+			{
+				LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue(value1)},
+				Points:      []metricdata.Point{metricdata.NewInt64Point(endTime1, bigValue)},
+				StartTime:   startTime1,
+			}, {
+				LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue(value2)},
+				Points:      []metricdata.Point{metricdata.NewInt64Point(endTime1, 1)},
+				StartTime:   startTime1,
+			},
+		},
+	}
+	summary := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{
+			Name:      metric2name,
+			Type:      metricdata.TypeSummary,
+			LabelKeys: []metricdata.LabelKey{{Key: label1name}},
+		},
+		TimeSeries: []*metricdata.TimeSeries{
+			{
+				LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue(value2)},
+				Points:      []metricdata.Point{metricdata.NewSummaryPoint(endTime1, &metricdata.Summary{})},
+				StartTime:   startTime1,
+			},
+		},
+	}
+	if err := exp.ExportMetrics(ctx, []*metricdata.Metric{metric, summary}); err != nil {
+		t.Fatalf("exporting metrics failed: %v", err)
+	}
+	checkErrStorage(t, errStore, nil)
+	if _, ok := exp.projDataMap[project1]; ok {
+		t.Errorf("project %s got row data, want none", project1)
+	}
+	pd, ok := exp.projDataMap[project2]
+	if !ok {
+		t.Fatalf("project %s got no row data", project2)
+	}
+	pd.uploadRowData(pd.bndler.(*mockBundler).rowDataArr)
+
+	cl := exp.client.(*mockMetricClient)
+	checkMetricClient(t, cl, [][]int64{{bigValue}})
+	if len(cl.reqs) == 1 {
+		if res := cl.reqs[0].TimeSeries[0].Resource; !proto.Equal(res, resource2) {
+			t.Errorf("resource got: %v, want: %v", res, resource2)
+		}
+	}
+	if n := len(exp.metricSources); n != 0 {
+		t.Errorf("number of metric sources after upload got: %d, want: 0", n)
+	}
+}
+
+// TestOTelExporter tests that opentelemetry metrics are converted and distributed by their projects.
+func TestOTelExporter(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) {
+		return project1, nil
+	}
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID})
+	rm := &otelmetricdata.ResourceMetrics{
+		ScopeMetrics: []otelmetricdata.ScopeMetrics{
+			{
+				Metrics: []otelmetricdata.Metrics{
+					{
+						Name: metric1name,
+						Data: otelmetricdata.Sum[int64]{
+							DataPoints: []otelmetricdata.DataPoint[int64]{
+								{
+									Attributes: attribute.NewSet(attribute.String(label1name, value1)),
+									StartTime:  startTime1,
+									Time:       endTime1,
+									Value:      7,
+								},
+							},
+							Temporality: otelmetricdata.CumulativeTemporality,
+							IsMonotonic: true,
+						},
+					}, {
+						Name: metric3name,
+						Data: otelmetricdata.Histogram[float64]{
+							DataPoints: []otelmetricdata.HistogramDataPoint[float64]{
+								{
+									StartTime:    startTime1,
+									Time:         endTime1,
+									Count:        2,
+									Bounds:       []float64{1, 10},
+									BucketCounts: []uint64{1, 0, 1},
+									Sum:          20.5,
+								},
+							},
+							Temporality: otelmetricdata.CumulativeTemporality,
+						},
+					},
+				},
+			},
+		},
+	}
+	if err := NewOTelExporter(exp).Export(ctx, rm); err != nil {
+		t.Fatalf("exporting opentelemetry metrics failed: %v", err)
+	}
+	checkErrStorage(t, errStore, nil)
+
+	rds := exp.projDataMap[project1].bndler.(*mockBundler).rowDataArr
+	if len(rds) != 2 {
+		t.Fatalf("number of row data got: %d, want: 2", len(rds))
+	}
+	if data, ok := rds[0].Row.Data.(*view.SumData); !ok || data.Value != 7 {
+		t.Errorf("data of sum got: %#v, want: sum of 7", rds[0].Row.Data)
+	}
+	if len(rds[0].Row.Tags) != 1 || rds[0].Row.Tags[0].Value != value1 {
+		t.Errorf("tags of sum got: %v, want: %s=%s", rds[0].Row.Tags, label1name, value1)
+	}
+	data, ok := rds[1].Row.Data.(*view.DistributionData)
+	if !ok {
+		t.Fatalf("data of histogram got: %#v, want: distribution", rds[1].Row.Data)
+	}
+	if data.Count != 2 || data.Mean != 10.25 || len(data.CountPerBucket) != 3 {
+		t.Errorf("data of histogram got: %#v, want: count 2, mean 10.25 and 3 buckets", data)
+	}
+}
+
+// TestOTelExporterResourceAndLabelKeys tests that opentelemetry resources are mapped to monitored
+// resources, that label keys of an instrument don't change between exports, that data points with
+// other attributes are reported on every export instead of being exported, and that shutting
+// down the OTelExporter doesn't shut down the StatsExporter it wraps.
+func TestOTelExporterResourceAndLabelKeys(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) {
+		return project1, nil
+	}
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID})
+	newRM := func(attrs ...attribute.KeyValue) *otelmetricdata.ResourceMetrics {
+		return &otelmetricdata.ResourceMetrics{
+			Resource: sdkresource.NewSchemaless(
+				attribute.String("cloud.platform", "gcp_compute_engine"),
+				attribute.String("cloud.account.id", project1),
+				attribute.String("cloud.availability_zone", "us-central1-a"),
+				attribute.String("host.id", "1234"),
+			),
+			ScopeMetrics: []otelmetricdata.ScopeMetrics{
+				{
+					Metrics: []otelmetricdata.Metrics{
+						{
+							Name: metric1name,
+							Data: otelmetricdata.Gauge[int64]{
+								DataPoints: []otelmetricdata.DataPoint[int64]{
+									{
+										Attributes: attribute.NewSet(attrs...),
+										Time:       endTime1,
+										Value:      7,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	o := NewOTelExporter(exp)
+	// Label keys are not fixed by an export without data points.
+	inst := otelInstrument{name: metric2name}
+	o.instrumentLabelKeys(inst, nil)
+	if keys, unknown := o.instrumentLabelKeys(inst, []attribute.Set{attribute.NewSet(attribute.String(label1name, value1))}); len(keys) != 1 || len(unknown) != 0 {
+		t.Errorf("label keys got: %v with unknown keys %v, want: [%s] without unknown keys", keys, unknown, label1name)
+	}
+
+	if err := o.Export(ctx, newRM(attribute.String(label1name, value1))); err != nil {
+		t.Fatalf("exporting opentelemetry metrics failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		err := o.Export(ctx, newRM(attribute.String(label1name, value1), attribute.String(label2name, value2)))
+		if err == nil || !strings.Contains(err.Error(), label2name) {
+			t.Errorf("exporting metrics with new attribute got: %v, want error on %s", err, label2name)
+		}
+	}
+	if err := o.Export(ctx, newRM(attribute.String(label1name, value1))); err != nil {
+		t.Fatalf("exporting opentelemetry metrics failed: %v", err)
+	}
+	checkErrStorage(t, errStore, nil)
+
+	rds := exp.projDataMap[project1].bndler.(*mockBundler).rowDataArr
+	if len(rds) != 2 {
+		t.Fatalf("number of row data got: %d, want: 2", len(rds))
+	}
+	for _, rd := range rds {
+		if rd.View != rds[0].View {
+			t.Errorf("views of the same instrument differ: %v, %v", rd.View, rds[0].View)
+		}
+		if len(rd.Row.Tags) != 1 || rd.Row.Tags[0].Value != value1 {
+			t.Errorf("tags got: %v, want: %s=%s", rd.Row.Tags, label1name, value1)
+		}
+	}
+	res, err := exp.resourceOf(rds[0])
+	if err != nil {
+		t.Fatalf("getting resource failed: %v", err)
+	}
+	wantRes := &monitoredrespb.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":  project1,
+			"zone":        "us-central1-a",
+			"instance_id": "1234",
+		},
+	}
+	if !proto.Equal(res, wantRes) {
+		t.Errorf("resource got: %v, want: %v", res, wantRes)
+	}
+
+	if err := o.Shutdown(ctx); err != nil {
+		t.Fatalf("shutting down opentelemetry exporter failed: %v", err)
+	}
+	if err := o.Export(ctx, newRM()); err != errOTelShutdown {
+		t.Errorf("exporting after shutdown got: %v, want: %v", err, errOTelShutdown)
+	}
+	select {
+	case <-exp.done:
+		t.Errorf("stats exporter is closed by shutting down opentelemetry exporter")
+	default:
+	}
+}
+
+// TestEvictIdleProjects tests that exporter flushes and removes data of idle projects, and projects
+// being forgotten explicitly.
+func TestEvictIdleProjects(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) {
+		switch rd.Row {
+		case view1row1:
+			return project1, nil
+		default:
+			return project2, nil
+		}
+	}
+	// Idle TTL is long enough so that the evicting goroutine does not interfere the test.
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID, ProjectIdleTTL: time.Hour})
+	defer exp.Close()
+	exp.ExportView(&view.Data{
+		View:  view1,
+		Start: startTime1,
+		End:   endTime1,
+		Rows:  []*view.Row{view1row1, view1row2},
+	})
+	pd1, pd2 := exp.projDataMap[project1], exp.projDataMap[project2]
+	pd1.lastUsed = pd1.lastUsed.Add(-2 * time.Hour)
+
+	exp.evictIdleProjects(time.Now())
+	checkErrStorage(t, errStore, nil)
+	checkExpProjData(t, exp, map[string][]*RowData{
+		project2: []*RowData{{view1, startTime1, endTime1, view1row2}},
+	})
+	if flushCount := pd1.bndler.(*mockBundler).flushCount; flushCount != 1 {
+		t.Errorf("number of flushes of idle project got: %d, want: 1", flushCount)
+	}
+
+	exp.ForgetProject(project2)
+	checkExpProjData(t, exp, nil)
+	if flushCount := pd2.bndler.(*mockBundler).flushCount; flushCount != 1 {
+		t.Errorf("number of flushes of forgotten project got: %d, want: 1", flushCount)
+	}
+
+	// Row data are not added to stopped project data, but to project data created again.
+	rd := &RowData{view1, startTime1, endTime1, view1row2}
+	if err := pd2.addRowData(rd); err != errProjectDataStopped {
+		t.Errorf("adding row data to forgotten project got: %v, want: %v", err, errProjectDataStopped)
+	}
+	exp.ExportView(&view.Data{
+		View:  view1,
+		Start: startTime1,
+		End:   endTime1,
+		Rows:  []*view.Row{view1row2},
+	})
+	checkErrStorage(t, errStore, nil)
+	checkExpProjData(t, exp, map[string][]*RowData{project2: []*RowData{rd}})
+	if len(pd2.bndler.(*mockBundler).rowDataArr) != 1 {
+		t.Errorf("row data added to the bundler of forgotten project")
+	}
+}
+
+// TestShutdownTwice tests that shutting down the exporter more than once is harmless.
+func TestShutdownTwice(t *testing.T) {
+	exp, _ := newMockExp(t, &Options{ProjectIdleTTL: time.Hour})
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("first Shutdown() failed: %v", err)
+	}
+	if err := exp.Close(); err != nil {
+		t.Errorf("Close() after Shutdown() failed: %v", err)
+	}
+}
+
+// TestFlushOversized tests that Flush waits for uploads of row data too large to be bundled.
+func TestFlushOversized(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) { return project1, nil }
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID})
+	defer exp.Close()
+	exp.getProjectData(project1).bndler.(*mockBundler).addErr = bundler.ErrOversizedItem
+	exp.ExportView(&view.Data{
+		View:  view1,
+		Start: startTime1,
+		End:   endTime1,
+		Rows:  []*view.Row{view1row1},
+	})
+
+	if err := exp.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, exp.client.(*mockMetricClient), [][]int64{{1}})
+}
+
+// TestOverflowPolicy tests that row data are dropped or added as designated by overflow policy
+// when the bundle overflows.
+func TestOverflowPolicy(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) { return project1, nil }
+	vd := &view.Data{
+		View:  view1,
+		Start: startTime1,
+		End:   endTime1,
+		Rows:  []*view.Row{view1row1},
+	}
+	rds := []*RowData{{view1, startTime1, endTime1, view1row1}}
+
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID})
+	exp.getProjectData(project1).bndler.(*mockBundler).addErr = bundler.ErrOverflow
+	exp.ExportView(vd)
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "failed to add row data with view " + view1.Name,
+			errSuffix: bundler.ErrOverflow.Error(),
+			rds:       rds,
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkExpProjData(t, exp, map[string][]*RowData{project1: nil})
+
+	// Row data waits for room with the default timeout when OverflowTimeout is not set.
+	exp, errStore = newMockExp(t, &Options{GetProjectID: getProjectID, OverflowPolicy: OverflowBlock})
+	mb := exp.getProjectData(project1).bndler.(*mockBundler)
+	mb.addErr = bundler.ErrOverflow
+	mb.onAddWait = func(ctx context.Context, _ *RowData) {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > defaultOverflowTimeout {
+			t.Errorf("deadline of waiting for room got: %v, %v, want: within %v", deadline, ok, defaultOverflowTimeout)
+		}
+	}
+	exp.ExportView(vd)
+	checkErrStorage(t, errStore, nil)
+	checkExpProjData(t, exp, map[string][]*RowData{project1: rds})
+
+	// Row data that can't find room in time is dropped with OverflowBlock policy.
+	exp, errStore = newMockExp(t, &Options{GetProjectID: getProjectID, OverflowPolicy: OverflowBlock})
+	mb = exp.getProjectData(project1).bndler.(*mockBundler)
+	mb.addErr, mb.addWaitErr = bundler.ErrOverflow, context.DeadlineExceeded
+	exp.ExportView(vd)
+	wantErrRdCheck = []errRowDataCheck{
+		{
+			errPrefix: "failed to add row data with view " + view1.Name,
+			errSuffix: context.DeadlineExceeded.Error(),
+			rds:       rds,
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkExpProjData(t, exp, map[string][]*RowData{project1: nil})
+
+	exp, errStore = newMockExp(t, &Options{GetProjectID: getProjectID, OverflowPolicy: OverflowDropNextBundle})
+	pd := exp.getProjectData(project1)
+	mb = pd.bndler.(*mockBundler)
+	mb.addErr = bundler.ErrOverflow
+	mb.onAddWait = func(context.Context, *RowData) {
+		// Uploads outside of the bundler are not dropped.
+		pd.uploadRowData(rds)
+		// The first bundle handed over for upload while waiting is dropped, and the next one is
+		// uploaded.
+		pd.uploadBundle(rds)
+		pd.uploadBundle(rds)
+	}
+	exp.ExportView(vd)
+	checkExpProjData(t, exp, map[string][]*RowData{project1: rds})
+	wantErrRdCheck = []errRowDataCheck{
+		{
+			errPrefix: "bundle for project " + project1,
+			errSuffix: "to make room for newer row data",
+			rds:       rds,
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, exp.client.(*mockMetricClient), [][]int64{{1}, {1}})
+
+	// The bundle that the row data joins is not dropped.
+	exp, errStore = newMockExp(t, &Options{GetProjectID: getProjectID, OverflowPolicy: OverflowDropNextBundle})
+	pd = exp.getProjectData(project1)
+	mb = pd.bndler.(*mockBundler)
+	mb.addErr = bundler.ErrOverflow
+	mb.onAddWait = func(_ context.Context, rd *RowData) {
+		pd.uploadBundle([]*RowData{rd})
+	}
+	exp.ExportView(vd)
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, exp.client.(*mockMetricClient), [][]int64{{1}})
+
+	// No bundle is dropped after the row data finds room without a drop, or can't find room in
+	// time.
+	for _, addWaitErr := range []error{nil, context.DeadlineExceeded} {
+		exp, errStore = newMockExp(t, &Options{GetProjectID: getProjectID, OverflowPolicy: OverflowDropNextBundle})
+		pd = exp.getProjectData(project1)
+		mb = pd.bndler.(*mockBundler)
+		mb.addErr, mb.addWaitErr = bundler.ErrOverflow, addWaitErr
+		exp.ExportView(vd)
+		if pd.takeDropRequest(rds) {
+			t.Errorf("bundle is to be dropped after waiting for room with error %v", addWaitErr)
+		}
+	}
+}
+
+// TestRowDataSize tests that size of row data grows with its tags and distribution buckets.
+func TestRowDataSize(t *testing.T) {
+	small := rowDataSize(&RowData{view1, startTime1, endTime1, view1row1})
+	tagged := rowDataSize(&RowData{view2, startTime2, endTime2, view2row1})
+	dist := rowDataSize(&RowData{view3, startTime1, endTime1, view3row1})
+	if small <= 0 || tagged <= small || dist <= small {
+		t.Errorf("row data sizes got: %d, %d, %d, want positive sizes growing with tags and buckets", small, tagged, dist)
+	}
+}
+
+// TestFlushDeadline tests that Flush returns error listing pending projects when the context is
+// done before flush is finished.
+func TestFlushDeadline(t *testing.T) {
+	getProjectID := func(rd *RowData) (string, error) {
+		switch rd.Row {
+		case view1row1:
+			return project1, nil
+		default:
+			return project2, nil
+		}
+	}
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID})
+	exp.ExportView(&view.Data{
+		View:  view1,
+		Start: startTime1,
+		End:   endTime1,
+		Rows:  []*view.Row{view1row1, view1row2},
+	})
+	flushBlock := make(chan struct{})
+	exp.projDataMap[project1].bndler.(*mockBundler).flushBlock = flushBlock
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := exp.Shutdown(flushCtx)
+	flushErr, ok := err.(*FlushError)
+	if !ok {
+		t.Fatalf("Shutdown() error got: %v, want *FlushError", err)
+	}
+	if flushErr.Err != context.DeadlineExceeded {
+		t.Errorf("context error got: %v, want: %v", flushErr.Err, context.DeadlineExceeded)
+	}
+	if want := []string{project1}; !reflect.DeepEqual(flushErr.PendingProjects, want) {
+		t.Errorf("pending projects got: %v, want: %v", flushErr.PendingProjects, want)
+	}
+	if !exp.client.(*mockMetricClient).closed {
+		t.Error("metric client is not closed")
+	}
+	close(flushBlock)
+	checkErrStorage(t, errStore, nil)
+}
+
 //
 func TestUploadNoError(t *testing.T) {
 	pd, cl, errStore := newMockUploader(t, &Options{})
@@ -198,61 +802,255 @@ func TestUploadWithMetricClientError(t *testing.T) {
 	checkMetricClient(t, cl, wantClData)
 }
 
-// TestMakeResource tests that exporter can create monitored resource dynamically.
-func TestMakeResource(t *testing.T) {
-	makeResource := func(rd *RowData) (*monitoredrespb.MonitoredResource, error) {
-		switch rd.Row {
-		case view1row1:
-			return resource1, nil
-		case view1row2:
-			return resource2, nil
-		default:
-			return nil, unrecognizedDataError
-		}
-	}
-	pd, cl, errStore := newMockUploader(t, &Options{MakeResource: makeResource})
+// TestUploadRetry tests that exporter retries RPC calls failed with retryable errors, and reports
+// errors only when it gives up retrying.
+func TestUploadRetry(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{RetryMaxAttempts: 2})
+	unavailableErr := status.Error(codes.Unavailable, "service unavailable")
+	// The first request succeeds on second attempt, and the second request fails on both
+	// attempts.
+	cl.addReturnErrs(unavailableErr, nil, unavailableErr, unavailableErr)
 	rd := []*RowData{
 		{view1, startTime1, endTime1, view1row1},
 		{view1, startTime1, endTime1, view1row2},
+		{view1, startTime1, endTime1, view1row3},
+		{view2, startTime2, endTime2, view2row1},
+		{view2, startTime2, endTime2, view2row2},
 	}
 	pd.uploadRowData(rd)
-	checkErrStorage(t, errStore, nil)
-	checkMetricClient(t, cl, [][]int64{{1, 2}})
 
-	tsArr := cl.reqs[0].TimeSeries
-	for i, wantResource := range []*monitoredrespb.MonitoredResource{resource1, resource2} {
-		if resource := tsArr[i].Resource; resource != wantResource {
-			t.Errorf("%d-th time series resource got: %#v, want: %#v", i, resource, wantResource)
-		}
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "RPC call to create time series failed",
+			errSuffix: "service unavailable",
+			rds: []*RowData{
+				{view2, startTime2, endTime2, view2row1},
+				{view2, startTime2, endTime2, view2row2},
+			},
+		},
 	}
-}
+	checkErrStorage(t, errStore, wantErrRdCheck)
 
-// TestMakeLabel tests that exporter can correctly handle label manipulation process, including
-// merging default label with tags, and removing unexported labels.
-func TestMakeLabel(t *testing.T) {
-	opts := &Options{
-		DefaultLabels: map[string]string{
-			label1name: value4,
-			label4name: value5,
-		},
-		UnexportedLabels: []string{label3name, label5name},
+	wantClData := [][]int64{
+		{1, 2, 3},
+		{1, 2, 3},
+		{4, 5},
+		{4, 5},
 	}
-	pd, cl, errStore := newMockUploader(t, opts)
+	checkMetricClient(t, cl, wantClData)
+}
+
+// TestUploadNoRetryOnPermanentError tests that exporter does not retry RPC calls failed with
+// non-retryable errors.
+func TestUploadNoRetryOnPermanentError(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{RetryMaxAttempts: 3})
+	cl.addReturnErrs(status.Error(codes.InvalidArgument, "invalid argument"))
 	rd := []*RowData{
 		{view1, startTime1, endTime1, view1row1},
 		{view2, startTime2, endTime2, view2row1},
 	}
 	pd.uploadRowData(rd)
-	checkErrStorage(t, errStore, nil)
-	checkMetricClient(t, cl, [][]int64{{1, 4}})
 
-	wantLabels1 := map[string]string{
-		label1name: value4,
-		label4name: value5,
-	}
-	wantLabels2 := map[string]string{
-		// default value for key1 is suppressed, and value defined in tag of view2row1 is
-		// used.
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "RPC call to create time series failed",
+			errSuffix: "invalid argument",
+			rds: []*RowData{
+				{view1, startTime1, endTime1, view1row1},
+				{view2, startTime2, endTime2, view2row1},
+			},
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, [][]int64{{1, 4}})
+}
+
+// newPartialError makes the error of a request with total time series, whose time series at indices
+// failed by cause, with status details as stackdriver returns.
+func newPartialError(t *testing.T, cause string, total int, indices ...int) error {
+	badReq := &errdetails.BadRequest{}
+	for _, idx := range indices {
+		badReq.FieldViolations = append(badReq.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       fmt.Sprintf("timeSeries[%d].points[0]", idx),
+			Description: cause,
+		})
+	}
+	summary := &monitoringpb.CreateTimeSeriesSummary{
+		TotalPointCount:   int32(total),
+		SuccessPointCount: int32(total - len(indices)),
+	}
+	// The message is deliberately different from what stackdriver writes, so that only details
+	// are used.
+	st, err := status.New(codes.InvalidArgument, "some time series failed").WithDetails(badReq, summary)
+	if err != nil {
+		t.Fatalf("adding status details failed: %v", err)
+	}
+	return st.Err()
+}
+
+// TestUploadPartialFailure tests that only row data of failed time series are reported, using
+// status details of the error.
+func TestUploadPartialFailure(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{})
+	cl.addReturnErrs(
+		newPartialError(t, "Points must be written in order.", 3, 0, 2),
+		newPartialError(t, "Unknown metric.", 2, 0, 1),
+	)
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+		{view1, startTime1, endTime1, view1row3},
+		{view2, startTime2, endTime2, view2row1},
+		{view2, startTime2, endTime2, view2row2},
+	}
+	pd.uploadRowData(rd)
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "RPC call to create time series failed",
+			errSuffix: "Points must be written in order.",
+			rds: []*RowData{
+				{view1, startTime1, endTime1, view1row1},
+				{view1, startTime1, endTime1, view1row3},
+			},
+		}, {
+			errPrefix: "RPC call to create time series failed",
+			errSuffix: "Unknown metric.",
+			rds: []*RowData{
+				{view2, startTime2, endTime2, view2row1},
+				{view2, startTime2, endTime2, view2row2},
+			},
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, [][]int64{{1, 2, 3}, {4, 5}})
+}
+
+// TestParsePartialFailures tests parsing of partial failures from errors without field violations,
+// whose messages are in the forms returned by stackdriver, and fallback to reporting all row data.
+func TestParsePartialFailures(t *testing.T) {
+	summaryErr := func(msg string, total, success int32) error {
+		summary := &monitoringpb.CreateTimeSeriesSummary{TotalPointCount: total, SuccessPointCount: success}
+		st, err := status.New(codes.InvalidArgument, msg).WithDetails(summary)
+		if err != nil {
+			t.Fatalf("adding status details failed: %v", err)
+		}
+		return st.Err()
+	}
+	const (
+		samplingMsg = "One or more TimeSeries could not be written: One or more points were written more frequently than the maximum sampling period configured for the metric.: timeSeries[0-1]"
+		orderMsg    = "One or more TimeSeries could not be written: Points must be written in order. One or more of the points specified had an older start time than the most recent point.: timeSeries[2]"
+	)
+	tests := []struct {
+		name         string
+		err          error
+		wantFailures []partialFailure
+		wantOK       bool
+	}{
+		{
+			name: "message",
+			err:  status.Error(codes.InvalidArgument, samplingMsg),
+			wantFailures: []partialFailure{
+				{"One or more points were written more frequently than the maximum sampling period configured for the metric.", []int{0, 1}},
+			},
+			wantOK: true,
+		},
+		{
+			name: "message with summary",
+			err:  summaryErr(orderMsg, 3, 2),
+			wantFailures: []partialFailure{
+				{"Points must be written in order. One or more of the points specified had an older start time than the most recent point.", []int{2}},
+			},
+			wantOK: true,
+		},
+		{
+			name:   "message disagreeing with summary",
+			err:    summaryErr(orderMsg, 3, 0),
+			wantOK: false,
+		},
+		{
+			name:   "unknown message",
+			err:    status.Error(codes.InvalidArgument, "Request was invalid."),
+			wantOK: false,
+		},
+		{
+			name:   "index out of range",
+			err:    status.Error(codes.InvalidArgument, "One or more TimeSeries could not be written: Unknown metric.: timeSeries[3]"),
+			wantOK: false,
+		},
+		{
+			name:   "not status",
+			err:    invalidDataError,
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		failures, ok := parsePartialFailures(tt.err, 3)
+		if ok != tt.wantOK {
+			t.Errorf("%s: ok got: %v, want: %v", tt.name, ok, tt.wantOK)
+			continue
+		}
+		if ok && !reflect.DeepEqual(failures, tt.wantFailures) {
+			t.Errorf("%s: failures got: %v, want: %v", tt.name, failures, tt.wantFailures)
+		}
+	}
+}
+
+// TestMakeResource tests that exporter can create monitored resource dynamically.
+func TestMakeResource(t *testing.T) {
+	makeResource := func(rd *RowData) (*monitoredrespb.MonitoredResource, error) {
+		switch rd.Row {
+		case view1row1:
+			return resource1, nil
+		case view1row2:
+			return resource2, nil
+		default:
+			return nil, unrecognizedDataError
+		}
+	}
+	pd, cl, errStore := newMockUploader(t, &Options{MakeResource: makeResource})
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+	}
+	pd.uploadRowData(rd)
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1, 2}})
+
+	tsArr := cl.reqs[0].TimeSeries
+	for i, wantResource := range []*monitoredrespb.MonitoredResource{resource1, resource2} {
+		if resource := tsArr[i].Resource; resource != wantResource {
+			t.Errorf("%d-th time series resource got: %#v, want: %#v", i, resource, wantResource)
+		}
+	}
+}
+
+// TestMakeLabel tests that exporter can correctly handle label manipulation process, including
+// merging default label with tags, and removing unexported labels.
+func TestMakeLabel(t *testing.T) {
+	opts := &Options{
+		DefaultLabels: map[string]string{
+			label1name: value4,
+			label4name: value5,
+		},
+		UnexportedLabels: []string{label3name, label5name},
+	}
+	pd, cl, errStore := newMockUploader(t, opts)
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view2, startTime2, endTime2, view2row1},
+	}
+	pd.uploadRowData(rd)
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1, 4}})
+
+	wantLabels1 := map[string]string{
+		label1name: value4,
+		label4name: value5,
+	}
+	wantLabels2 := map[string]string{
+		// default value for key1 is suppressed, and value defined in tag of view2row1 is
+		// used.
 		label1name: value1,
 		label2name: value2,
 		label4name: value5,
@@ -263,3 +1061,1213 @@ func TestMakeLabel(t *testing.T) {
 		checkLabels(t, prefix, tsArr[i].Metric.Labels, wantLabels)
 	}
 }
+
+// TestSanitizeLabels tests that exporter rewrites label keys, drops colliding labels and labels
+// over the limit, and truncates long label values, reporting each change.
+func TestSanitizeLabels(t *testing.T) {
+	dottedKey, underscoreKey := getKey("http.method"), getKey("http_method")
+	v := &view.View{
+		Name:        "metric_4",
+		TagKeys:     []tag.Key{dottedKey, underscoreKey},
+		Measure:     stats.Int64("metric_4", "", stats.UnitDimensionless),
+		Aggregation: view.Sum(),
+	}
+	longValue := strings.Repeat("a", 2000)
+	// key3 is not a tag key of the view.
+	row := &view.Row{
+		Tags: []tag.Tag{{dottedKey, value2}, {underscoreKey, longValue}, {key3, value3}},
+		Data: &view.SumData{Value: 6},
+	}
+	var warnings []*Warning
+	opts := &Options{
+		DefaultLabels:              map[string]string{label1name: value1, label2name: value2},
+		SanitizeLabels:             true,
+		LabelValueTruncationSuffix: "...",
+		MaxLabelsPerMetric:         2,
+		OnWarning:                  func(w *Warning) { warnings = append(warnings, w) },
+	}
+	pd, cl, errStore := newMockUploader(t, opts)
+	pd.uploadRowData([]*RowData{{v, startTime1, endTime1, row}})
+	pd.uploadRowData([]*RowData{{v, startTime2, endTime2, row}})
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{6}, {6}})
+
+	// The key already valid wins the collision, though "http.method" comes first in sort order.
+	wantLabels := map[string]string{
+		"http_method": longValue[:1021] + "...",
+		label1name:    value1,
+	}
+	checkLabels(t, "sanitized labels mismatch", cl.reqs[0].TimeSeries[0].Metric.Labels, wantLabels)
+
+	// Warnings on label keys are reported only once for the view, while truncation is reported
+	// for each row data. Warnings on labels of a row data may be reported in any order.
+	type warningKey struct {
+		kind  WarningKind
+		label string
+	}
+	wantWarnings := map[warningKey]int{
+		{LabelDropped, label2name}:           1,
+		{LabelKeyRewritten, "http.method"}:   1,
+		{LabelKeyCollision, "http.method"}:   1,
+		{LabelUnknown, label3name}:           1,
+		{LabelValueTruncated, "http_method"}: 2,
+	}
+	gotWarnings := map[warningKey]int{}
+	for _, w := range warnings {
+		gotWarnings[warningKey{w.Kind, w.Label}]++
+	}
+	if !reflect.DeepEqual(gotWarnings, wantWarnings) {
+		t.Errorf("warnings got: %v, want: %v", gotWarnings, wantWarnings)
+	}
+}
+
+// TestMetricType tests that exporter makes metric types by options, and rejects invalid ones.
+func TestMetricType(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{MetricPrefix: "custom.googleapis.com/opencensus"})
+	pd.uploadRowData([]*RowData{{view1, startTime1, endTime1, view1row1}})
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1}})
+	wantType := "custom.googleapis.com/opencensus/" + metric1name
+	if metricType := cl.reqs[0].TimeSeries[0].Metric.Type; metricType != wantType {
+		t.Errorf("metric type got: %s, want: %s", metricType, wantType)
+	}
+
+	metricTypeFunc := func(rd *RowData, projectID string) string {
+		if rd.View == view1 {
+			return "workload.googleapis.com/" + projectID + "/" + rd.View.Name
+		}
+		return "invalid type"
+	}
+	pd, cl, errStore = newMockUploader(t, &Options{MetricTypeFunc: metricTypeFunc})
+	pd.uploadRowData([]*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view2, startTime2, endTime2, view2row1},
+	})
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: `invalid metric type "invalid type" of view ` + metric2name,
+			rds:       []*RowData{{view2, startTime2, endTime2, view2row1}},
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, [][]int64{{1}})
+	wantType = "workload.googleapis.com/" + project1 + "/" + metric1name
+	if metricType := cl.reqs[0].TimeSeries[0].Metric.Type; metricType != wantType {
+		t.Errorf("metric type got: %s, want: %s", metricType, wantType)
+	}
+}
+
+// TestUploadRateLimit tests that requests exceeding rate limit of the project are dropped or
+// delayed as designated by the policy.
+func TestUploadRateLimit(t *testing.T) {
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+		{view1, startTime1, endTime1, view1row3},
+		{view2, startTime2, endTime2, view2row1},
+		{view2, startTime2, endTime2, view2row2},
+	}
+	// Bucket is refilled too slowly to affect the test.
+	rateLimit := &RateLimit{RequestsPerSecond: 0.001, Policy: RateLimitDrop}
+
+	pd, cl, errStore := newMockUploader(t, &Options{RateLimit: rateLimit})
+	pd.uploadRowData(rd)
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "request to create time series for project " + project1,
+			errSuffix: "dropped by rate limit",
+			rds: []*RowData{
+				{view2, startTime2, endTime2, view2row1},
+				{view2, startTime2, endTime2, view2row2},
+			},
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, [][]int64{{1, 2, 3}})
+
+	// Requests wait for the rate limit with RateLimitWait policy. The bucket of 3 time series is
+	// refilled in 20ms for the second request.
+	rateLimit = &RateLimit{SeriesPerSecond: 100, SeriesBurst: 3, Policy: RateLimitWait}
+	pd, cl, errStore = newMockUploader(t, &Options{RateLimit: rateLimit})
+	start := time.Now()
+	pd.uploadRowData(rd)
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("uploading row data took %v, want waiting for the rate limit", elapsed)
+	}
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1, 2, 3}, {4, 5}})
+
+	// Waiting requests are dropped when the context is done.
+	limiter := newProjectLimiter(&RateLimit{RequestsPerSecond: 0.001, Policy: RateLimitWait})
+	if _, ok := limiter.take(ctx, 1); !ok {
+		t.Error("first request is dropped, want it allowed by the burst")
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, ok := limiter.take(cancelCtx, 1); ok {
+		t.Error("request waiting with canceled context is allowed, want dropped")
+	}
+
+	// Per-project override removes the limit.
+	opts := &Options{RateLimit: rateLimit, ProjectRateLimits: map[string]*RateLimit{project1: nil}}
+	pd, _, _ = newMockUploader(t, opts)
+	if pd.limiter != nil {
+		t.Error("rate limit of the project is not overridden")
+	}
+}
+
+// TestObservabilityUpload tests that the exporter records accepted row data, bundles and RPC calls
+// with their projects and codes.
+func TestObservabilityUpload(t *testing.T) {
+	defer registerObservabilityViews(t)()
+	getProjectID := func(rd *RowData) (string, error) { return project1, nil }
+	exp, errStore := newMockExp(t, &Options{GetProjectID: getProjectID, RetryMaxAttempts: 2})
+	exp.ExportView(&view.Data{
+		View:  view1,
+		Start: startTime1,
+		End:   endTime1,
+		Rows:  []*view.Row{view1row1, view1row2},
+	})
+	pd := exp.getProjectData(project1)
+	cl := exp.client.(*mockMetricClient)
+	// The first attempt of the first upload fails, and succeeds on retry.
+	cl.addReturnErrs(status.Error(codes.DeadlineExceeded, "deadline exceeded"))
+	pd.uploadRowData([]*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+	})
+	pd.uploadRowData([]*RowData{{view2, startTime2, endTime2, view2row1}})
+	checkErrStorage(t, errStore, nil)
+
+	projectTag := map[tag.Key]string{observability.KeyProjectID: project1}
+	checkObservedCount(t, observability.RowsView, map[tag.Key]string{
+		observability.KeyProjectID: project1,
+		observability.KeyOutcome:   observability.OutcomeAccepted,
+	}, 2)
+	checkObservedCount(t, observability.BundleSizeView, projectTag, 2)
+	if data, ok := observedData(t, observability.BundleSizeView, projectTag).(*view.DistributionData); ok && data.Mean != 1.5 {
+		t.Errorf("mean bundle size got: %v, want: 1.5", data.Mean)
+	}
+	for code, count := range map[string]int64{"DEADLINE_EXCEEDED": 1, "OK": 2} {
+		tags := map[tag.Key]string{observability.KeyProjectID: project1, observability.KeyCode: code}
+		checkObservedCount(t, observability.RPCCountView, tags, count)
+		checkObservedCount(t, observability.RPCLatencyView, tags, count)
+	}
+}
+
+// TestObservabilityOverflow tests that the exporter records row data failed to be added to
+// bundles, and row data of bundles dropped to make room for newer ones.
+func TestObservabilityOverflow(t *testing.T) {
+	defer registerObservabilityViews(t)()
+	getProjectID := func(rd *RowData) (string, error) { return project1, nil }
+	exp, _ := newMockExp(t, &Options{GetProjectID: getProjectID})
+	exp.getProjectData(project1).bndler.(*mockBundler).addErr = bundler.ErrOverflow
+	exp.ExportView(&view.Data{View: view1, Start: startTime1, End: endTime1, Rows: []*view.Row{view1row1}})
+	checkObservedCount(t, observability.BundlerOverflowsView, map[tag.Key]string{observability.KeyProjectID: project1}, 1)
+
+	exp, _ = newMockExp(t, &Options{GetProjectID: getProjectID, OverflowPolicy: OverflowDropNextBundle})
+	pd := exp.getProjectData(project1)
+	mb := pd.bndler.(*mockBundler)
+	mb.addErr = bundler.ErrOverflow
+	mb.onAddWait = func(context.Context, *RowData) {
+		pd.uploadBundle([]*RowData{
+			{view1, startTime1, endTime1, view1row2},
+			{view1, startTime1, endTime1, view1row3},
+		})
+	}
+	exp.ExportView(&view.Data{View: view1, Start: startTime1, End: endTime1, Rows: []*view.Row{view1row1}})
+	// One row data is dropped by the bundler of the first exporter, and two by the second one.
+	checkObservedCount(t, observability.RowsView, map[tag.Key]string{
+		observability.KeyProjectID: project1,
+		observability.KeyOutcome:   observability.OutcomeDropped,
+	}, 3)
+	checkObservedCount(t, observability.BundlerOverflowsView, map[tag.Key]string{observability.KeyProjectID: project1}, 1)
+}
+
+// TestObservabilityThrottle tests that the exporter records requests delayed or dropped by rate
+// limits.
+func TestObservabilityThrottle(t *testing.T) {
+	defer registerObservabilityViews(t)()
+	rds := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+		{view1, startTime1, endTime1, view1row3},
+		{view2, startTime2, endTime2, view2row1},
+		{view2, startTime2, endTime2, view2row2},
+	}
+	pd, _, _ := newMockUploader(t, &Options{RateLimit: &RateLimit{RequestsPerSecond: 0.001, Policy: RateLimitDrop}})
+	pd.uploadRowData(rds)
+	pd, _, _ = newMockUploader(t, &Options{RateLimit: &RateLimit{SeriesPerSecond: 100, SeriesBurst: 3, Policy: RateLimitWait}})
+	pd.uploadRowData(rds)
+
+	dropped := map[tag.Key]string{observability.KeyProjectID: project1, observability.KeyThrottle: observability.ThrottleDropped}
+	delayed := map[tag.Key]string{observability.KeyProjectID: project1, observability.KeyThrottle: observability.ThrottleDelayed}
+	checkObservedCount(t, observability.ThrottledRequestsView, dropped, 1)
+	checkObservedCount(t, observability.ThrottledRequestsView, delayed, 1)
+	if data, ok := observedData(t, observability.ThrottleDelayView, delayed).(*view.DistributionData); ok && data.Min <= 0 {
+		t.Errorf("throttle delay got: %vms, want positive", data.Min)
+	}
+}
+
+// TestClientOptionsForProject tests that projects with the same credentials ID share a client,
+// and that failures of getting client options are reported with row data of the project.
+func TestClientOptionsForProject(t *testing.T) {
+	clientOptionsForProject := func(projectID string) (string, []option.ClientOption, error) {
+		switch projectID {
+		case project1, project2:
+			return "tenant", []option.ClientOption{option.WithCredentialsFile("tenant.json")}, nil
+		case "project-3":
+			return "", nil, nil
+		case "project-5":
+			// The project has its own client, though its options look same.
+			return "", []option.ClientOption{option.WithCredentialsFile("tenant.json")}, nil
+		default:
+			return "", nil, unrecognizedDataError
+		}
+	}
+	exp, errStore := newMockExp(t, &Options{ClientOptionsForProject: clientOptionsForProject})
+	rds := []*RowData{{view1, startTime1, endTime1, view1row1}}
+
+	pd1, pd2 := exp.newProjectData(project1), exp.newProjectData(project2)
+	pd3, pd4 := exp.newProjectData("project-3"), exp.newProjectData("project-4")
+	pd5 := exp.newProjectData("project-5")
+	pd1.uploadRowData(rds)
+	pd2.uploadRowData(rds)
+	pd3.uploadRowData(rds)
+	pd4.uploadRowData(rds)
+	pd5.uploadRowData(rds)
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "failed to get client options for project project-4",
+			errSuffix: unrecognizedDataError.Error(),
+			rds:       rds,
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	if pd1.client != pd2.client {
+		t.Error("projects with the same credentials ID don't share the client")
+	}
+	if pd5.client == pd1.client || pd5.client == exp.client {
+		t.Error("project without credentials ID doesn't have its own client")
+	}
+	if pd1.client == exp.client || pd3.client != exp.client {
+		t.Error("client made from ClientOptions is not used exactly for projects without client options")
+	}
+	checkMetricClient(t, pd1.client.(*mockMetricClient), [][]int64{{1}, {1}})
+	checkMetricClient(t, exp.client.(*mockMetricClient), [][]int64{{1}})
+
+	// Clients are closed when no projects use them.
+	tenantClient, ownClient := pd1.client.(*mockMetricClient), pd5.client.(*mockMetricClient)
+	pd2.stop()
+	pd5.stop()
+	if tenantClient.closed {
+		t.Error("shared client is closed while a project uses it")
+	}
+	if !ownClient.closed {
+		t.Error("client of a stopped project is not closed")
+	}
+	if len(exp.clients) != 1 {
+		t.Errorf("number of cached clients got: %d, want: 1", len(exp.clients))
+	}
+	if err := exp.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if !tenantClient.closed {
+		t.Error("clients made from ClientOptionsForProject are not closed")
+	}
+}
+
+// TestDryRun tests that requests are written as JSON lines in dry run, split as usual.
+func TestDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	exp, errStore := newMockExp(t, &Options{DryRunWriter: &buf})
+	pd := exp.newProjectData(project1)
+	pd.uploadRowData([]*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+		{view1, startTime1, endTime1, view1row3},
+		{view2, startTime2, endTime2, view2row1},
+	})
+	checkErrStorage(t, errStore, nil)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("number of lines got: %d, want: 2\n%s", len(lines), buf.String())
+	}
+	for i, wantCount := range []int{3, 1} {
+		rec := &dryRunRecord{}
+		if err := json.Unmarshal([]byte(lines[i]), rec); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i, err)
+		}
+		if rec.Method != "CreateTimeSeries" || rec.Project != project1 || rec.SeriesCount != wantCount {
+			t.Errorf("line %d got: (%s, %s, %d), want: (CreateTimeSeries, %s, %d)", i, rec.Method, rec.Project, rec.SeriesCount, project1, wantCount)
+		}
+		req := &monitoringpb.CreateTimeSeriesRequest{}
+		if err := jsonpb.UnmarshalString(string(rec.Request), req); err != nil {
+			t.Errorf("request of line %d is not valid: %v", i, err)
+		} else if len(req.TimeSeries) != wantCount {
+			t.Errorf("number of time series in line %d got: %d, want: %d", i, len(req.TimeSeries), wantCount)
+		}
+	}
+}
+
+// testSink saves all time series and row data passed to it, and returns predefined errors.
+type testSink struct {
+	timeSeries [][]*monitoringpb.TimeSeries
+	rds        [][]*RowData
+	returnErrs []error
+}
+
+func (s *testSink) Export(projectID string, timeSeries []*monitoringpb.TimeSeries, rds []*RowData) error {
+	s.timeSeries = append(s.timeSeries, timeSeries)
+	s.rds = append(s.rds, rds)
+	if len(s.returnErrs) == 0 {
+		return nil
+	}
+	err := s.returnErrs[0]
+	s.returnErrs = s.returnErrs[1:]
+	return err
+}
+
+// TestSink tests that time series are passed to Sink with their row data, and that errors from
+// Sink are reported.
+func TestSink(t *testing.T) {
+	sink := &testSink{returnErrs: []error{nil, unrecognizedDataError}}
+	exp, errStore := newMockExp(t, &Options{Sink: sink, ValidateRowData: true})
+	if _, ok := exp.client.(sinkClient); !ok {
+		t.Fatalf("metric client got: %T, want: sinkClient", exp.client)
+	}
+	pd := exp.newProjectData(project1)
+	rds := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+		{view1, startTime1, endTime1, view1row3},
+		{view2, startTime2, endTime2, view2row1},
+	}
+	pd.uploadRowData(rds)
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "sink failed to export time series for project " + project1,
+			errSuffix: unrecognizedDataError.Error(),
+			rds:       rds[3:],
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	if len(sink.timeSeries) != 2 {
+		t.Fatalf("number of exports got: %d, want: 2", len(sink.timeSeries))
+	}
+	if err := checkRowDataArr(sink.rds[0], rds[:3]); err != nil {
+		t.Errorf("row data of first export mismatch: %v", err)
+	}
+	for i, ts := range sink.timeSeries[0] {
+		got := ts.Points[0].Value.Value.(*monitoringpb.TypedValue_Int64Value).Int64Value
+		if want := int64(i + 1); got != want {
+			t.Errorf("value of %d-th time series got: %d, want: %d", i, got, want)
+		}
+	}
+}
+
+// TestTrackCumulative tests that resets of cumulative series are detected with start time adjusted,
+// and that out of order points are dropped.
+func TestTrackCumulative(t *testing.T) {
+	var warnings []*Warning
+	onWarning := func(w *Warning) { warnings = append(warnings, w) }
+	pd, cl, errStore := newMockUploader(t, &Options{TrackCumulative: true, OnWarning: onWarning})
+
+	end1, end2, end3 := startTime1.Add(time.Minute), startTime1.Add(2*time.Minute), startTime1.Add(3*time.Minute)
+	pd.uploadRowData([]*RowData{{view1, startTime1, end1, view1row2}})
+	// Value decreases, so the series is reset.
+	pd.uploadRowData([]*RowData{{view1, startTime1, end2, view1row1}})
+	pd.uploadRowData([]*RowData{{view1, startTime1, end3, view1row3}})
+	pd.uploadRowData([]*RowData{{view1, startTime1, end2, view1row3}})
+
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{2}, {1}, {3}})
+	wantStarts := []time.Time{startTime1, end1.Add(time.Millisecond), end1.Add(time.Millisecond)}
+	for i, wantStart := range wantStarts {
+		if i >= len(cl.reqs) {
+			break
+		}
+		start, err := ptypes.Timestamp(cl.reqs[i].TimeSeries[0].Points[0].Interval.StartTime)
+		if err != nil || !start.Equal(wantStart) {
+			t.Errorf("start time of %d-th request got: %v, want: %v", i, start, wantStart)
+		}
+	}
+	wantKinds := []WarningKind{CumulativeReset, CumulativeOutOfOrder}
+	if len(warnings) != len(wantKinds) {
+		t.Fatalf("number of warnings got: %d, want: %d", len(warnings), len(wantKinds))
+	}
+	for i, kind := range wantKinds {
+		if warnings[i].Kind != kind {
+			t.Errorf("kind of %d-th warning got: %v, want: %v", i, warnings[i].Kind, kind)
+		}
+	}
+}
+
+// TestSeriesTrackerLimit tests that least recently used series are forgotten first, and that
+// older states don't replace newer ones.
+func TestSeriesTrackerLimit(t *testing.T) {
+	tracker := newSeriesTracker(2)
+	for i, key := range []string{"a", "b", "a", "c"} {
+		tracker.commit(&seriesState{key: key, end: endTime1.Add(time.Duration(i) * time.Minute)})
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := tracker.states[key]; ok != want {
+			t.Errorf("series %s is tracked: %v, want: %v", key, ok, want)
+		}
+	}
+	tracker.commit(&seriesState{key: "a", end: endTime1})
+	if end := tracker.get("a").end; !end.Equal(endTime1.Add(2 * time.Minute)) {
+		t.Errorf("end of series a got: %v, want: %v", end, endTime1.Add(2*time.Minute))
+	}
+}
+
+// TestMetricKindDeltaNotExported tests that states of delta series are committed only when their
+// points are exported, so that the next delta covers the interval of the point not exported, and
+// that a request has only one point of a series.
+func TestMetricKindDeltaNotExported(t *testing.T) {
+	metricKinds := map[string]metricpb.MetricDescriptor_MetricKind{view1.Name: metricpb.MetricDescriptor_DELTA}
+	pd, cl, errStore := newMockUploader(t, &Options{MetricKinds: metricKinds})
+	// rds has cumulative values 1, 2, 3, 5 and 8 ending at successive minutes.
+	var rds []*RowData
+	for i, value := range []float64{1, 2, 3, 5, 8} {
+		row := &view.Row{Data: &view.SumData{Value: value}}
+		rds = append(rds, &RowData{view1, startTime1, startTime1.Add(time.Duration(i+1) * time.Minute), row})
+	}
+
+	pd.uploadRowData(rds[:1])
+	cl.addReturnErrs(invalidDataError)
+	pd.uploadRowData(rds[1:2])
+	pd.uploadRowData(rds[2:3])
+	// Points of the same series go to separate requests.
+	pd.uploadRowData(rds[3:])
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "RPC call to create time series failed for project " + project1,
+			errSuffix: invalidDataError.Error(),
+			rds:       rds[1:2],
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, [][]int64{{1}, {2}, {2}, {3}})
+	for i, wantStart := range []time.Time{rds[0].End, rds[0].End, rds[2].End, rds[3].End} {
+		if i >= len(cl.reqs) {
+			break
+		}
+		start, err := ptypes.Timestamp(cl.reqs[i].TimeSeries[0].Points[0].Interval.StartTime)
+		if err != nil || !start.Equal(wantStart) {
+			t.Errorf("start time of %d-th request got: %v, want: %v", i, start, wantStart)
+		}
+	}
+}
+
+// TestMetricKindDelta tests that cumulative data are converted to deltas, handling the first point
+// and resets.
+func TestMetricKindDelta(t *testing.T) {
+	var warnings []*Warning
+	onWarning := func(w *Warning) { warnings = append(warnings, w) }
+	metricKinds := map[string]metricpb.MetricDescriptor_MetricKind{view1.Name: metricpb.MetricDescriptor_DELTA}
+	pd, cl, errStore := newMockUploader(t, &Options{MetricKinds: metricKinds, OnWarning: onWarning})
+
+	end1, end2, end3 := startTime1.Add(time.Minute), startTime1.Add(2*time.Minute), startTime1.Add(3*time.Minute)
+	// The first point is only the base of the next delta.
+	pd.uploadRowData([]*RowData{{view1, startTime1, end1, view1row2}})
+	pd.uploadRowData([]*RowData{{view1, startTime1, end2, view1row3}})
+	// Value decreases, so the series is reset.
+	pd.uploadRowData([]*RowData{{view1, startTime1, end3, view1row1}})
+
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1}, {1}})
+	for i, wantStart := range []time.Time{end1, end2} {
+		if i >= len(cl.reqs) {
+			break
+		}
+		start, err := ptypes.Timestamp(cl.reqs[i].TimeSeries[0].Points[0].Interval.StartTime)
+		if err != nil || !start.Equal(wantStart) {
+			t.Errorf("start time of %d-th request got: %v, want: %v", i, start, wantStart)
+		}
+	}
+	if len(warnings) != 1 || warnings[0].Kind != CumulativeReset {
+		t.Errorf("warnings got: %v, want a warning of %v", warnings, CumulativeReset)
+	}
+	if kind := pd.parent.newMetricDescriptor(view1, project1, "metric").MetricKind; kind != metricpb.MetricDescriptor_DELTA {
+		t.Errorf("metric kind of descriptor got: %v, want: %v", kind, metricpb.MetricDescriptor_DELTA)
+	}
+}
+
+// TestMetricKindDeltaConcurrent tests that an upload waits for the series being converted by
+// another upload, so that deltas of the series are converted one at a time.
+func TestMetricKindDeltaConcurrent(t *testing.T) {
+	metricKinds := map[string]metricpb.MetricDescriptor_MetricKind{view1.Name: metricpb.MetricDescriptor_DELTA}
+	pd, cl, errStore := newMockUploader(t, &Options{MetricKinds: metricKinds})
+
+	end1, end2 := startTime1.Add(time.Minute), startTime1.Add(2*time.Minute)
+	pd.uploadRowData([]*RowData{{view1, startTime1, end1, view1row2}})
+	key := pd.tracker.lru.Front().Value.(*seriesState).key
+	// Another upload is converting the series.
+	pd.tracker.acquire(key)
+	done := make(chan struct{})
+	go func() {
+		pd.uploadRowData([]*RowData{{view1, startTime1, end2, view1row3}})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("upload finished while the series is being converted by another upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pd.tracker.release(key)
+	<-done
+
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1}})
+	if !pd.tracker.tryAcquire(key) {
+		t.Error("series is not released after the upload")
+	}
+}
+
+// TestMetricKindDeltaResetDistribution tests that the delta of a reset distribution has no range
+// and only exemplars of its interval, while the tracker keeps the cumulative distribution as is.
+func TestMetricKindDeltaResetDistribution(t *testing.T) {
+	opts := &Options{
+		MetricKinds:             map[string]metricpb.MetricDescriptor_MetricKind{view3.Name: metricpb.MetricDescriptor_DELTA},
+		ExportDistributionRange: true,
+		ExportExemplars:         true,
+	}
+	pd, cl, errStore := newMockUploader(t, opts)
+	pd.uploadRowData([]*RowData{{view3, startTime1, endTime1, view3row1}})
+	// Later start time means a reset, and exemplars recorded at endTime1 are before the delta.
+	pd.uploadRowData([]*RowData{{view3, startTime2, endTime2, view3row1}})
+	checkErrStorage(t, errStore, nil)
+	if len(cl.reqs) != 1 {
+		t.Fatalf("number of requests got: %d, want: 1", len(cl.reqs))
+	}
+
+	dist := cl.reqs[0].TimeSeries[0].Points[0].Value.GetDistributionValue()
+	if dist.Count != 2 || dist.Range != nil || len(dist.Exemplars) != 0 {
+		t.Errorf("delta got: (count %d, range %v, %d exemplars), want: (count 2, no range, no exemplars)", dist.Count, dist.Range, len(dist.Exemplars))
+	}
+	tracked := pd.tracker.lru.Front().Value.(*seriesState).value.GetDistributionValue()
+	if tracked.Range == nil || len(tracked.Exemplars) != 2 {
+		t.Errorf("tracked distribution got: (range %v, %d exemplars), want: (range, 2 exemplars)", tracked.Range, len(tracked.Exemplars))
+	}
+}
+
+// TestMetricKindGauge tests that cumulative data are converted to gauges, and that invalid metric
+// kinds are rejected.
+func TestMetricKindGauge(t *testing.T) {
+	metricKinds := map[string]metricpb.MetricDescriptor_MetricKind{view1.Name: metricpb.MetricDescriptor_GAUGE}
+	pd, cl, errStore := newMockUploader(t, &Options{MetricKinds: metricKinds})
+	pd.uploadRowData([]*RowData{{view1, startTime1, endTime1, view1row1}})
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1}})
+	if len(cl.reqs) == 1 && cl.reqs[0].TimeSeries[0].Points[0].Interval.StartTime != nil {
+		t.Error("gauge point has start time")
+	}
+
+	metricKinds[view1.Name] = metricpb.MetricDescriptor_METRIC_KIND_UNSPECIFIED
+	if _, err := NewStatsExporter(ctx, &Options{MetricKinds: metricKinds}); err == nil {
+		t.Error("exporter is created with invalid metric kind")
+	}
+}
+
+// TestDeltaDistribution tests that delta of distributions is computed from cumulative ones.
+func TestDeltaDistribution(t *testing.T) {
+	// last has values 1 and 3, and cur has 5 and 7 in addition.
+	last := &distributionpb.Distribution{Count: 2, Mean: 2, SumOfSquaredDeviation: 2, BucketCounts: []int64{1, 1, 0}}
+	cur := &distributionpb.Distribution{Count: 4, Mean: 4, SumOfSquaredDeviation: 20, BucketCounts: []int64{1, 2, 1}}
+	delta, ok := deltaDistribution(cur, last)
+	if !ok {
+		t.Fatal("delta of distributions is not valid")
+	}
+	if delta.Count != 2 || delta.Mean != 6 || delta.SumOfSquaredDeviation != 2 {
+		t.Errorf("delta got: (count %d, mean %v, ssd %v), want: (count 2, mean 6, ssd 2)", delta.Count, delta.Mean, delta.SumOfSquaredDeviation)
+	}
+	if want := []int64{0, 1, 1}; !reflect.DeepEqual(delta.BucketCounts, want) {
+		t.Errorf("bucket counts got: %v, want: %v", delta.BucketCounts, want)
+	}
+	if _, ok := deltaDistribution(last, cur); ok {
+		t.Error("delta of decreasing distributions is valid")
+	}
+
+	// Decrease of any bucket count or the sum means a reset, even when the count doesn't decrease.
+	for _, reset := range []*distributionpb.Distribution{
+		{Count: 2, Mean: 2, SumOfSquaredDeviation: 2, BucketCounts: []int64{2, 0, 0}},
+		{Count: 2, Mean: 1, SumOfSquaredDeviation: 2, BucketCounts: []int64{1, 1, 0}},
+	} {
+		if !distributionReset(reset, last) {
+			t.Errorf("distribution %v after %v is not a reset", reset, last)
+		}
+		if _, ok := deltaDistribution(reset, last); ok {
+			t.Errorf("delta of distribution %v after %v is valid", reset, last)
+		}
+	}
+	if distributionReset(last, last) {
+		t.Error("unchanged distribution is a reset")
+	}
+}
+
+// TestCreateMetricDescriptor tests that exporter creates metric descriptors derived from views
+// only once per project.
+func TestCreateMetricDescriptor(t *testing.T) {
+	opts := &Options{
+		DefaultLabels:           map[string]string{label4name: value5},
+		UnexportedLabels:        []string{label3name},
+		CreateMetricDescriptors: true,
+	}
+	pd, cl, errStore := newMockUploader(t, opts)
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view2, startTime2, endTime2, view2row1},
+	}
+	pd.uploadRowData(rd)
+	pd.uploadRowData(rd)
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1, 4}, {1, 4}})
+
+	if gotLen := len(cl.descReqs); gotLen != 2 {
+		t.Fatalf("number of metric descriptor creation requests got: %d, want: 2", gotLen)
+	}
+	desc := cl.descReqs[1].MetricDescriptor
+	if desc.Type != metric2name {
+		t.Errorf("metric type got: %s, want: %s", desc.Type, metric2name)
+	}
+	if desc.MetricKind != metricpb.MetricDescriptor_CUMULATIVE {
+		t.Errorf("metric kind got: %v, want: %v", desc.MetricKind, metricpb.MetricDescriptor_CUMULATIVE)
+	}
+	if desc.ValueType != metricpb.MetricDescriptor_INT64 {
+		t.Errorf("value type got: %v, want: %v", desc.ValueType, metricpb.MetricDescriptor_INT64)
+	}
+	wantKeys := []string{label1name, label2name, label4name}
+	if len(desc.Labels) != len(wantKeys) {
+		t.Fatalf("number of labels got: %d, want: %d", len(desc.Labels), len(wantKeys))
+	}
+	for i, wantKey := range wantKeys {
+		if key := desc.Labels[i].Key; key != wantKey {
+			t.Errorf("%d-th label key got: %s, want: %s", i+1, key, wantKey)
+		}
+	}
+}
+
+// TestCreateMetricDescriptorError tests that row data are reported when their metric descriptor
+// can't be created.
+func TestCreateMetricDescriptorError(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{CreateMetricDescriptors: true})
+	cl.addDescReturnErrs(invalidDataError)
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+		{view2, startTime2, endTime2, view2row1},
+	}
+	pd.uploadRowData(rd)
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "failed to create metric descriptor",
+			errSuffix: invalidDataError.Error(),
+			rds:       []*RowData{{view1, startTime1, endTime1, view1row1}},
+		}, {
+			errPrefix: "failed to create metric descriptor",
+			errSuffix: invalidDataError.Error(),
+			rds:       []*RowData{{view1, startTime1, endTime1, view1row2}},
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, [][]int64{{4}})
+	if gotLen := len(cl.descReqs); gotLen != 2 {
+		t.Errorf("number of metric descriptor creation requests got: %d, want: 2", gotLen)
+	}
+}
+
+// TestCreateMetricDescriptorAlreadyExists tests that the metric descriptor in the project is used
+// when the metric already exists, instead of the one made from the view.
+func TestCreateMetricDescriptorAlreadyExists(t *testing.T) {
+	opts := &Options{
+		CreateMetricDescriptors: true,
+		ValidateRowData:         true,
+	}
+	pd, cl, errStore := newMockUploader(t, opts)
+	cl.addDescReturnErrs(status.Error(codes.AlreadyExists, "already exists"))
+	cl.addDescs(project1, &metricpb.MetricDescriptor{
+		Type:       metric1name,
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+	})
+	rd := []*RowData{{view1, startTime1, endTime1, view1row1}}
+	pd.uploadRowData(rd)
+	pd.uploadRowData(rd)
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "row data mismatches metric " + metric1name,
+			errSuffix: "metric kind got: CUMULATIVE, want: GAUGE",
+			rds:       rd,
+		}, {
+			errPrefix: "row data mismatches metric " + metric1name,
+			errSuffix: "metric kind got: CUMULATIVE, want: GAUGE",
+			rds:       rd,
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, nil)
+	if gotLen := len(cl.descReqs); gotLen != 1 {
+		t.Errorf("number of metric descriptor creation requests got: %d, want: 1", gotLen)
+	}
+}
+
+// TestValidateRowData tests that row data mismatching metric descriptors are rejected individually.
+func TestValidateRowData(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{ValidateRowData: true})
+	cl.addDescs(project1,
+		&metricpb.MetricDescriptor{
+			Type:       metric1name,
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_INT64,
+		},
+		&metricpb.MetricDescriptor{
+			Type:       metric2name,
+			MetricKind: metricpb.MetricDescriptor_CUMULATIVE,
+			ValueType:  metricpb.MetricDescriptor_INT64,
+			Labels: []*labelpb.LabelDescriptor{
+				{Key: label1name},
+				{Key: label2name},
+				{Key: label3name},
+			},
+		},
+	)
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view2, startTime2, endTime2, view2row1},
+		{view2, startTime2, endTime2, view2row2},
+	}
+	pd.uploadRowData(rd)
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "row data mismatches metric " + metric1name,
+			errSuffix: "metric kind got: CUMULATIVE, want: GAUGE",
+			rds:       []*RowData{{view1, startTime1, endTime1, view1row1}},
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, [][]int64{{4, 5}})
+	if len(errStore.errRds) == 1 {
+		if _, ok := errStore.errRds[0].err.(*MetricMismatchError); !ok {
+			t.Errorf("reported error got: %T, want: *MetricMismatchError", errStore.errRds[0].err)
+		}
+	}
+}
+
+// TestValidateRowDataLabelMismatch tests that row data with labels not defined in metric descriptor
+// or without metric descriptor are rejected.
+func TestValidateRowDataLabelMismatch(t *testing.T) {
+	opts := &Options{
+		DefaultLabels:   map[string]string{label4name: value4},
+		ValidateRowData: true,
+	}
+	pd, cl, errStore := newMockUploader(t, opts)
+	cl.addDescs(project1, &metricpb.MetricDescriptor{
+		Type:       metric1name,
+		MetricKind: metricpb.MetricDescriptor_CUMULATIVE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+	})
+	rd := []*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view2, startTime2, endTime2, view2row1},
+	}
+	pd.uploadRowData(rd)
+
+	wantErrRdCheck := []errRowDataCheck{
+		{
+			errPrefix: "row data mismatches metric " + metric1name,
+			errSuffix: "label " + label4name + " is not defined",
+			rds:       []*RowData{{view1, startTime1, endTime1, view1row1}},
+		}, {
+			errPrefix: "failed to get metric descriptor of view " + metric2name,
+			errSuffix: "not found",
+			rds:       []*RowData{{view2, startTime2, endTime2, view2row1}},
+		},
+	}
+	checkErrStorage(t, errStore, wantErrRdCheck)
+	checkMetricClient(t, cl, nil)
+}
+
+// newMockSpool sets up spool of the exporter in a temporary directory. We don't start the
+// goroutine replaying spooled requests, so tests need to replay them manually. Errors on spooled
+// requests are recorded in returned storage. Returned function removes the directory.
+func newMockSpool(t *testing.T, exp *StatsExporter) (*spoolErrStorage, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("creating spool directory failed: %v", err)
+	}
+	exp.opts.SpoolDir = dir
+	exp.spool = newSpool(exp)
+	spoolErrStore := &spoolErrStorage{}
+	exp.onSpoolError = spoolErrStore.onSpoolError
+	return spoolErrStore, func() { os.RemoveAll(dir) }
+}
+
+// spoolErrStorage records errors on spooled requests, and numbers of time series reported with
+// them.
+type spoolErrStorage struct {
+	errs     []string
+	tsCounts []int
+}
+
+func (s *spoolErrStorage) onSpoolError(err error, projectID string, timeSeries []*monitoringpb.TimeSeries) {
+	s.errs = append(s.errs, err.Error())
+	s.tsCounts = append(s.tsCounts, len(timeSeries))
+}
+
+// spooledFiles returns spooled files of the project in the directory, checking that they match
+// files indexed by the spool.
+func spooledFiles(t *testing.T, s *spool, projectID string) []spoolFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := readSpoolDir(filepath.Join(s.dir, projectID), projectID)
+	indexed := s.files[projectID]
+	if len(files) != len(indexed) {
+		t.Errorf("number of spooled files got: %d, but %d in the index", len(files), len(indexed))
+	} else {
+		for i, file := range files {
+			if file.path != indexed[i].path || file.size != indexed[i].size {
+				t.Errorf("%d-th spooled file got: %s of %d bytes, but %s of %d bytes in the index", i, file.path, file.size, indexed[i].path, indexed[i].size)
+			}
+		}
+	}
+	var size int64
+	for _, projFiles := range s.files {
+		for _, file := range projFiles {
+			size += file.size
+		}
+	}
+	if size != s.size {
+		t.Errorf("total size of spooled files got: %d, want: %d", s.size, size)
+	}
+	return files
+}
+
+// TestSpool tests that requests failed with retryable errors are spooled, and replayed once the
+// project recovers.
+func TestSpool(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{})
+	spoolErrStore, cleanup := newMockSpool(t, pd.parent)
+	defer cleanup()
+	cl.addReturnErrs(status.Error(codes.Unavailable, "service unavailable"))
+
+	pd.uploadRowData([]*RowData{
+		{view1, startTime1, endTime1, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+	})
+	if files := spooledFiles(t, pd.parent.spool, project1); len(files) != 1 {
+		t.Errorf("number of spooled files got: %d, want: 1", len(files))
+	}
+	// Spooled request is replayed before the next upload.
+	pd.uploadRowData([]*RowData{{view2, startTime2, endTime2, view2row1}})
+
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1, 2}, {1, 2}, {4}})
+	if files := spooledFiles(t, pd.parent.spool, project1); len(files) != 0 {
+		t.Errorf("number of spooled files after replay got: %d, want: 0", len(files))
+	}
+	if len(spoolErrStore.errs) != 0 {
+		t.Errorf("errors on spooled requests got: %v, want none", spoolErrStore.errs)
+	}
+}
+
+// TestSpoolReplayRetry tests that replayed requests are retried like any other requests, and that
+// they are kept in the spool while the project is unavailable.
+func TestSpoolReplayRetry(t *testing.T) {
+	pd, cl, _ := newMockUploader(t, &Options{RetryMaxAttempts: 2})
+	_, cleanup := newMockSpool(t, pd.parent)
+	defer cleanup()
+	unavailable := status.Error(codes.Unavailable, "service unavailable")
+	cl.addReturnErrs(unavailable, unavailable)
+
+	pd.uploadRowData([]*RowData{{view1, startTime1, endTime1, view1row1}})
+	// Replay fails once, and succeeds on retry.
+	cl.addReturnErrs(unavailable)
+	pd.parent.spool.replay(pd)
+
+	checkMetricClient(t, cl, [][]int64{{1}, {1}, {1}, {1}})
+	if files := spooledFiles(t, pd.parent.spool, project1); len(files) != 0 {
+		t.Errorf("number of spooled files after replay got: %d, want: 0", len(files))
+	}
+}
+
+// TestSpoolReplayOrder tests that spooled points are replayed before later points of the same
+// series, and that later points are spooled after them while the project is unavailable.
+func TestSpoolReplayOrder(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{})
+	spoolErrStore, cleanup := newMockSpool(t, pd.parent)
+	defer cleanup()
+	unavailable := status.Error(codes.Unavailable, "service unavailable")
+	cl.addReturnErrs(unavailable, unavailable)
+
+	endTimes := []time.Time{endTime1, endTime1.Add(time.Second), endTime1.Add(2 * time.Second)}
+	for _, endTime := range endTimes[:2] {
+		pd.uploadRowData([]*RowData{{view1, startTime1, endTime, view1row1}})
+	}
+	// The second point is spooled without being uploaded, since the first one is not replayed.
+	if files := spooledFiles(t, pd.parent.spool, project1); len(files) != 2 {
+		t.Errorf("number of spooled files got: %d, want: 2", len(files))
+	}
+	pd.uploadRowData([]*RowData{{view1, startTime1, endTimes[2], view1row1}})
+
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1}, {1}, {1}, {1}, {1}})
+	// The first two requests are failed uploads of the first point, one from the upload and the
+	// other from the replay before the second point.
+	wantEndTimes := []time.Time{endTimes[0], endTimes[0], endTimes[0], endTimes[1], endTimes[2]}
+	for i, req := range cl.reqs {
+		end := req.TimeSeries[0].Points[0].Interval.EndTime
+		if got := time.Unix(end.Seconds, int64(end.Nanos)); !got.Equal(wantEndTimes[i]) {
+			t.Errorf("end time of %d-th request got: %v, want: %v", i, got, wantEndTimes[i])
+		}
+	}
+	if files := spooledFiles(t, pd.parent.spool, project1); len(files) != 0 {
+		t.Errorf("number of spooled files after replay got: %d, want: 0", len(files))
+	}
+	if len(spoolErrStore.errs) != 0 {
+		t.Errorf("errors on spooled requests got: %v, want none", spoolErrStore.errs)
+	}
+}
+
+// TestSpoolInvalidProjectID tests that requests of invalid project IDs are reported instead of
+// being spooled, so that project IDs can't make paths outside of the spool directory.
+func TestSpoolInvalidProjectID(t *testing.T) {
+	exp, errStore := newMockExp(t, &Options{})
+	_, cleanup := newMockSpool(t, exp)
+	defer cleanup()
+	cl := exp.client.(*mockMetricClient)
+	cl.addReturnErrs(status.Error(codes.Unavailable, "service unavailable"))
+
+	projectID := "../../x"
+	pd := exp.newProjectData(projectID)
+	rd := &RowData{view1, startTime1, endTime1, view1row1}
+	pd.uploadRowData([]*RowData{rd})
+
+	checkErrStorage(t, errStore, []errRowDataCheck{{
+		errPrefix: "failed to upload time series for project " + projectID,
+		errSuffix: `invalid project ID "../../x" for spool directory`,
+		rds:       []*RowData{rd},
+	}})
+	path := filepath.Join(exp.opts.SpoolDir, projectID)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("directory outside of spool directory is created: %s", path)
+	}
+}
+
+// TestSpoolDropStalePoints tests that spooled time series too old for stackdriver are dropped
+// instead of being replayed.
+func TestSpoolDropStalePoints(t *testing.T) {
+	pd, cl, errStore := newMockUploader(t, &Options{})
+	spoolErrStore, cleanup := newMockSpool(t, pd.parent)
+	defer cleanup()
+	cl.addReturnErrs(status.Error(codes.Unavailable, "service unavailable"))
+
+	staleEndTime := time.Now().Add(-26 * time.Hour)
+	staleStartTime := staleEndTime.Add(-10 * time.Second)
+	pd.uploadRowData([]*RowData{
+		{view1, staleStartTime, staleEndTime, view1row1},
+		{view1, startTime1, endTime1, view1row2},
+	})
+	pd.parent.spool.replay(pd)
+
+	checkErrStorage(t, errStore, nil)
+	checkMetricClient(t, cl, [][]int64{{1, 2}, {2}})
+	wantErr := "dropped 1 time series of spooled request for project " + project1 + " because their points are older than 25h0m0s"
+	if !reflect.DeepEqual(spoolErrStore.errs, []string{wantErr}) {
+		t.Errorf("errors on spooled requests got: %v, want: %v", spoolErrStore.errs, []string{wantErr})
+	} else if spoolErrStore.tsCounts[0] != 1 {
+		t.Errorf("number of dropped time series got: %d, want: 1", spoolErrStore.tsCounts[0])
+	}
+}
+
+// TestSpoolLimits tests that spooled requests exceeding limits are dropped and reported with their
+// time series, and that age of requests spooled by previous runs doesn't depend on modification
+// time of files.
+func TestSpoolLimits(t *testing.T) {
+	pd, cl, _ := newMockUploader(t, &Options{})
+	spoolErrStore, cleanup := newMockSpool(t, pd.parent)
+	defer cleanup()
+	unavailable := status.Error(codes.Unavailable, "service unavailable")
+	cl.addReturnErrs(unavailable, unavailable)
+
+	pd.uploadRowData([]*RowData{{view1, startTime1, endTime1, view1row1}})
+	files := spooledFiles(t, pd.parent.spool, project1)
+	if len(files) != 1 {
+		t.Fatalf("number of spooled files got: %d, want: 1", len(files))
+	}
+	// Touching the file must not make it look older.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(files[0].path, old, old); err != nil {
+		t.Fatalf("changing file times failed: %v", err)
+	}
+	// The spool of the next run loads the file.
+	spool := newSpool(pd.parent)
+	pd.parent.spool = spool
+	if err := spool.load(); err != nil {
+		t.Fatalf("loading spool failed: %v", err)
+	}
+	spool.maxAge = time.Hour
+	spool.maxBytes = files[0].size
+	// The new request is as large as the old one, so only the old one is dropped.
+	pd.uploadRowData([]*RowData{{view1, startTime1, endTime1, view1row2}})
+
+	wantErr := "dropped spooled request for project " + project1 + " because spool size exceeds"
+	if len(spoolErrStore.errs) != 1 {
+		t.Fatalf("number of errors on spooled requests got: %d, want: 1", len(spoolErrStore.errs))
+	}
+	if !strings.HasPrefix(spoolErrStore.errs[0], wantErr) {
+		t.Errorf("error on spooled requests got: %q, want: prefixed by %q", spoolErrStore.errs[0], wantErr)
+	}
+	if spoolErrStore.tsCounts[0] != 1 {
+		t.Errorf("number of dropped time series got: %d, want: 1", spoolErrStore.tsCounts[0])
+	}
+	if files := spooledFiles(t, spool, project1); len(files) != 1 {
+		t.Errorf("number of spooled files got: %d, want: 1", len(files))
+	}
+}
+
+// TestDistributionRangeAndExemplars tests that exporter exports range and exemplars of distributions
+// when asked to.
+func TestDistributionRangeAndExemplars(t *testing.T) {
+	opts := &Options{
+		ExportDistributionRange: true,
+		ExportExemplars:         true,
+	}
+	pd, cl, errStore := newMockUploader(t, opts)
+	pd.uploadRowData([]*RowData{{view3, startTime1, endTime1, view3row1}})
+	checkErrStorage(t, errStore, nil)
+	if len(cl.reqs) != 1 {
+		t.Fatalf("number of requests got: %d, want: 1", len(cl.reqs))
+	}
+
+	dist := cl.reqs[0].TimeSeries[0].Points[0].Value.GetDistributionValue()
+	if dist.Range.Min != 0.5 || dist.Range.Max != 20 {
+		t.Errorf("range got: [%v, %v], want: [0.5, 20]", dist.Range.Min, dist.Range.Max)
+	}
+	if len(dist.Exemplars) != 2 {
+		t.Fatalf("number of exemplars got: %d, want: 2", len(dist.Exemplars))
+	}
+	spanCtx := &monitoringpb.SpanContext{}
+	if err := ptypes.UnmarshalAny(dist.Exemplars[0].Attachments[0], spanCtx); err != nil {
+		t.Fatalf("unmarshalling span context failed: %v", err)
+	}
+	wantSpanName := fmt.Sprintf("projects/%s/traces/%s/spans/%s", project1, spanContext1.TraceID, spanContext1.SpanID)
+	if spanCtx.SpanName != wantSpanName {
+		t.Errorf("span name got: %s, want: %s", spanCtx.SpanName, wantSpanName)
+	}
+	droppedLabels := &monitoringpb.DroppedLabels{}
+	if err := ptypes.UnmarshalAny(dist.Exemplars[1].Attachments[0], droppedLabels); err != nil {
+		t.Fatalf("unmarshalling dropped labels failed: %v", err)
+	}
+	checkLabels(t, "dropped labels mismatch", droppedLabels.Label, map[string]string{label1name: value1})
+}
+
+// TestTraceExporter tests that trace exporter distributes span data by their projects, and uploads
+// them with error reporting.
+func TestTraceExporter(t *testing.T) {
+	sd1 := &trace.SpanData{
+		SpanContext: spanContext1,
+		Name:        "span_1",
+		StartTime:   startTime1,
+		EndTime:     endTime1,
+		Attributes:  map[string]interface{}{label1name: value1},
+	}
+	sd2 := &trace.SpanData{
+		SpanContext:  trace.SpanContext{TraceID: spanContext1.TraceID, SpanID: trace.SpanID{0x3}},
+		ParentSpanID: spanContext1.SpanID,
+		Name:         "span_2",
+		StartTime:    startTime2,
+		EndTime:      endTime2,
+	}
+	sd3 := &trace.SpanData{Name: "span_3"}
+	getProjectID := func(sd *trace.SpanData) (string, error) {
+		switch sd {
+		case sd1, sd2:
+			return project1, nil
+		case sd3:
+			return "", SpanDataNotApplicableError
+		default:
+			return "", unrecognizedDataError
+		}
+	}
+	var errSds []*trace.SpanData
+	onError := func(err error, sds ...*trace.SpanData) {
+		errSds = append(errSds, sds...)
+	}
+
+	exp, err := NewTraceExporter(ctx, &TraceOptions{GetProjectID: getProjectID, OnError: onError})
+	if err != nil {
+		t.Fatalf("creating trace exporter failed: %v", err)
+	}
+	exp.ExportSpan(sd1)
+	exp.ExportSpan(sd2)
+	exp.ExportSpan(sd3)
+	if len(exp.projDataMap) != 1 {
+		t.Fatalf("number of projects got: %d, want: 1", len(exp.projDataMap))
+	}
+	pd := exp.projDataMap[project1]
+	if sds := pd.bndler.(*mockSpanBundler).spanDataArr; len(sds) != 2 || sds[0] != sd1 || sds[1] != sd2 {
+		t.Errorf("span data in bundle got: %v, want: [%v %v]", sds, sd1, sd2)
+	}
+
+	cl := exp.client.(*mockTraceClient)
+	cl.returnErrs = []error{nil, invalidDataError}
+	pd.uploadSpanData([]*trace.SpanData{sd1, sd2})
+	pd.uploadSpanData([]*trace.SpanData{sd2})
+	if len(errSds) != 1 || errSds[0] != sd2 {
+		t.Errorf("reported span data got: %v, want: [%v]", errSds, sd2)
+	}
+	if len(cl.reqs) != 2 {
+		t.Fatalf("number of requests got: %d, want: 2", len(cl.reqs))
+	}
+	spans := cl.reqs[0].Spans
+	wantName := fmt.Sprintf("projects/%s/traces/%s/spans/%s", project1, spanContext1.TraceID, spanContext1.SpanID)
+	if spans[0].Name != wantName || spans[0].DisplayName.Value != "span_1" {
+		t.Errorf("span got: %s named %s, want: %s named span_1", spans[0].Name, spans[0].DisplayName.Value, wantName)
+	}
+	if spans[1].ParentSpanId != spanContext1.SpanID.String() {
+		t.Errorf("parent span ID got: %s, want: %s", spans[1].ParentSpanId, spanContext1.SpanID)
+	}
+	if value := spans[0].Attributes.AttributeMap[label1name].GetStringValue().Value; value != value1 {
+		t.Errorf("attribute value got: %s, want: %s", value, value1)
+	}
+}
+
+// TestTraceExporterRetryAndOversized tests that trace exporter retries RPC calls failed with
+// retryable errors, and that Close waits for uploads of span data too large to be bundled.
+func TestTraceExporterRetryAndOversized(t *testing.T) {
+	sd := &trace.SpanData{SpanContext: spanContext1, Name: "span_1"}
+	getProjectID := func(sd *trace.SpanData) (string, error) {
+		return project1, nil
+	}
+	var errSds []*trace.SpanData
+	onError := func(err error, sds ...*trace.SpanData) {
+		errSds = append(errSds, sds...)
+	}
+	exp, err := NewTraceExporter(ctx, &TraceOptions{GetProjectID: getProjectID, OnError: onError, RetryMaxAttempts: 2})
+	if err != nil {
+		t.Fatalf("creating trace exporter failed: %v", err)
+	}
+	cl := exp.client.(*mockTraceClient)
+	cl.returnErrs = []error{status.Error(codes.Unavailable, "unavailable"), nil}
+	pd := exp.getProjectData(project1)
+	pd.bndler.(*mockSpanBundler).addErr = bundler.ErrOversizedItem
+
+	exp.ExportSpan(sd)
+	if err := exp.Close(); err != nil {
+		t.Fatalf("closing trace exporter failed: %v", err)
+	}
+	if len(cl.reqs) != 2 {
+		t.Errorf("number of requests got: %d, want: 2", len(cl.reqs))
+	}
+	if len(errSds) != 0 {
+		t.Errorf("reported span data got: %v, want none", errSds)
+	}
+}
@@ -0,0 +1,268 @@
+package exportertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	exporter "github.com/lychung83/stackdriver-exporter"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Series is a time series captured by Recorder, simplified for assertions.
+type Series struct {
+	ProjectID      string            `json:"projectID"`
+	MetricType     string            `json:"metricType"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	ResourceType   string            `json:"resourceType"`
+	ResourceLabels map[string]string `json:"resourceLabels,omitempty"`
+	Start          time.Time         `json:"start"`
+	End            time.Time         `json:"end"`
+	// Value is the value of the point, one of int64, float64, bool, string and *Distribution.
+	Value interface{} `json:"value"`
+	// RowData is the row data that the series is made from.
+	RowData *exporter.RowData `json:"-"`
+}
+
+// Distribution is the value of a distribution point.
+type Distribution struct {
+	Count                 int64     `json:"count"`
+	Mean                  float64   `json:"mean"`
+	SumOfSquaredDeviation float64   `json:"sumOfSquaredDeviation"`
+	Bounds                []float64 `json:"bounds,omitempty"`
+	BucketCounts          []int64   `json:"bucketCounts,omitempty"`
+}
+
+// Recorder captures time series made by the exporter. It implements exporter.Sink, so it can be
+// used as Sink of exporter options to test GetProjectID, MakeResource and other options without
+// stackdriver. A Recorder must be created by NewRecorder().
+type Recorder struct {
+	// mu protects series.
+	mu     sync.Mutex
+	series []*Series
+}
+
+var _ exporter.Sink = (*Recorder)(nil)
+
+// NewRecorder creates a Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Export implements exporter.Sink.
+func (r *Recorder) Export(projectID string, timeSeries []*monitoringpb.TimeSeries, rds []*exporter.RowData) error {
+	series := make([]*Series, len(timeSeries))
+	for i, ts := range timeSeries {
+		s, err := newSeries(projectID, ts)
+		if err != nil {
+			return err
+		}
+		s.RowData = rds[i]
+		series[i] = s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series = append(r.series, series...)
+	return nil
+}
+
+func newSeries(projectID string, ts *monitoringpb.TimeSeries) (*Series, error) {
+	if len(ts.Points) != 1 {
+		return nil, fmt.Errorf("time series of metric %s has %d points, want 1", ts.GetMetric().GetType(), len(ts.Points))
+	}
+	pt := ts.Points[0]
+	s := &Series{
+		ProjectID:      projectID,
+		MetricType:     ts.GetMetric().GetType(),
+		Labels:         ts.GetMetric().GetLabels(),
+		ResourceType:   ts.GetResource().GetType(),
+		ResourceLabels: ts.GetResource().GetLabels(),
+	}
+	if start := pt.GetInterval().GetStartTime(); start != nil {
+		t, err := ptypes.Timestamp(start)
+		if err != nil {
+			return nil, err
+		}
+		s.Start = t.UTC()
+	}
+	end, err := ptypes.Timestamp(pt.GetInterval().GetEndTime())
+	if err != nil {
+		return nil, err
+	}
+	s.End = end.UTC()
+
+	switch v := pt.GetValue().GetValue().(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		s.Value = v.Int64Value
+	case *monitoringpb.TypedValue_DoubleValue:
+		s.Value = v.DoubleValue
+	case *monitoringpb.TypedValue_BoolValue:
+		s.Value = v.BoolValue
+	case *monitoringpb.TypedValue_StringValue:
+		s.Value = v.StringValue
+	case *monitoringpb.TypedValue_DistributionValue:
+		dist := v.DistributionValue
+		s.Value = &Distribution{
+			Count:                 dist.Count,
+			Mean:                  dist.Mean,
+			SumOfSquaredDeviation: dist.SumOfSquaredDeviation,
+			Bounds:                dist.GetBucketOptions().GetExplicitBuckets().GetBounds(),
+			BucketCounts:          dist.BucketCounts,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value type %T of metric %s", v, s.MetricType)
+	}
+	return s, nil
+}
+
+// Series returns all captured series, in the order of arrival.
+func (r *Recorder) Series() []*Series {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Series(nil), r.series...)
+}
+
+// Reset discards all captured series.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series = nil
+}
+
+// Find returns captured series matching all matchers, in the order of arrival.
+func (r *Recorder) Find(matchers ...Matcher) []*Series {
+	var found []*Series
+	for _, s := range r.Series() {
+		if s.Matches(matchers...) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// Matcher tells whether a series satisfies a condition.
+type Matcher func(*Series) bool
+
+// Matches tells whether s matches all matchers.
+func (s *Series) Matches(matchers ...Matcher) bool {
+	for _, m := range matchers {
+		if !m(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// Project matches series of the project.
+func Project(projectID string) Matcher {
+	return func(s *Series) bool { return s.ProjectID == projectID }
+}
+
+// MetricType matches series of the metric type.
+func MetricType(metricType string) Matcher {
+	return func(s *Series) bool { return s.MetricType == metricType }
+}
+
+// Label matches series with the metric label.
+func Label(key, value string) Matcher {
+	return func(s *Series) bool {
+		v, ok := s.Labels[key]
+		return ok && v == value
+	}
+}
+
+// ResourceType matches series of the monitored resource type.
+func ResourceType(resourceType string) Matcher {
+	return func(s *Series) bool { return s.ResourceType == resourceType }
+}
+
+// ResourceLabel matches series with the resource label.
+func ResourceLabel(key, value string) Matcher {
+	return func(s *Series) bool {
+		v, ok := s.ResourceLabels[key]
+		return ok && v == value
+	}
+}
+
+// Value matches series with the value. Integer values are compared as int64, and floating point
+// values as float64.
+func Value(value interface{}) Matcher {
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case int32:
+		value = int64(v)
+	case float32:
+		value = float64(v)
+	}
+	return func(s *Series) bool { return reflect.DeepEqual(s.Value, value) }
+}
+
+// Golden returns captured series in a stable JSON form for golden files. Series are sorted by
+// project, metric type, labels, resource and end time, so the order of arrival doesn't matter.
+func (r *Recorder) Golden() ([]byte, error) {
+	series := r.Series()
+	keys := make(map[*Series]string, len(series))
+	for _, s := range series {
+		keys[s] = fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%s", s.ProjectID, s.MetricType, labelsString(s.Labels), s.ResourceType, labelsString(s.ResourceLabels), s.End.Format(time.RFC3339Nano))
+	}
+	sort.SliceStable(series, func(i, j int) bool { return keys[series[i]] < keys[series[j]] })
+	data, err := json.MarshalIndent(series, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal series: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// CompareGolden compares captured series with the golden file, and returns error describing the
+// first difference. When update is set, the golden file is overwritten instead. Tests typically
+// pass a flag like -update as update.
+func (r *Recorder) CompareGolden(filename string, update bool) error {
+	got, err := r.Golden()
+	if err != nil {
+		return err
+	}
+	if update {
+		return ioutil.WriteFile(filename, got, 0644)
+	}
+	want, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read golden file: %v", err)
+	}
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	gotLines, wantLines := strings.Split(string(got), "\n"), strings.Split(string(want), "\n")
+	for i := 0; ; i++ {
+		var gotLine, wantLine string
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if gotLine != wantLine || len(gotLines) <= i || len(wantLines) <= i {
+			return fmt.Errorf("series mismatch golden file %s at line %d, got: %q, want: %q", filename, i+1, gotLine, wantLine)
+		}
+	}
+}
+
+func labelsString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%s,", key, labels[key])
+	}
+	return b.String()
+}
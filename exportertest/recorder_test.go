@@ -0,0 +1,116 @@
+package exportertest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	exporter "github.com/lychung83/stackdriver-exporter"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// recordedMetricPrefix is the metric prefix of exporters made by newRecordingExporter.
+const recordedMetricPrefix = "custom.googleapis.com/recorder"
+
+// newRecordingExporter creates an exporter exporting to a new recorder. Row data are exported to
+// the project given by their tag with recordedMetricPrefix, and their resource is generic_task of
+// the tag.
+func newRecordingExporter(t *testing.T) (*Recorder, *exporter.StatsExporter) {
+	rec := NewRecorder()
+	exp, err := exporter.NewStatsExporter(context.Background(), &exporter.Options{
+		Sink:         rec,
+		MetricPrefix: recordedMetricPrefix,
+		GetProjectID: func(rd *exporter.RowData) (string, error) {
+			return "project-" + rd.Row.Tags[0].Value, nil
+		},
+		MakeResource: func(rd *exporter.RowData) (*monitoredrespb.MonitoredResource, error) {
+			return &monitoredrespb.MonitoredResource{
+				Type:   "generic_task",
+				Labels: map[string]string{"task_id": rd.Row.Tags[0].Value},
+			}, nil
+		},
+		OnError: func(err error, _ ...*exporter.RowData) {
+			t.Errorf("error reported: %v", err)
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewStatsExporter() failed: %v", err)
+	}
+	return rec, exp
+}
+
+// TestRecorder tests that Recorder captures time series by project, and that matchers find them.
+func TestRecorder(t *testing.T) {
+	rec, exp := newRecordingExporter(t)
+	exp.ExportView(newViewData(testStart.Add(time.Minute), newRow("a", 1), newRow("b", 2)))
+	if err := exp.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	if got := len(rec.Series()); got != 2 {
+		t.Fatalf("number of series got: %d, want: 2", got)
+	}
+	found := rec.Find(Project("project-b"), MetricType(recordedMetricPrefix+"/test/count"), Label("key", "b"), ResourceType("generic_task"), ResourceLabel("task_id", "b"))
+	if len(found) != 1 {
+		t.Fatalf("number of series found got: %d, want: 1", len(found))
+	}
+	s := found[0]
+	if !s.Matches(Value(2)) {
+		t.Errorf("value got: %v, want: 2", s.Value)
+	}
+	if !s.Start.Equal(testStart) || !s.End.Equal(testStart.Add(time.Minute)) {
+		t.Errorf("interval got: [%v, %v], want: [%v, %v]", s.Start, s.End, testStart, testStart.Add(time.Minute))
+	}
+	if s.RowData == nil || s.RowData.Row.Tags[0].Value != "b" {
+		t.Errorf("row data of series is not recorded: %v", s.RowData)
+	}
+	if found := rec.Find(Project("project-a"), Value(2)); len(found) != 0 {
+		t.Errorf("series found with mismatching value: %v", found)
+	}
+
+	rec.Reset()
+	if got := len(rec.Series()); got != 0 {
+		t.Errorf("number of series after reset got: %d, want: 0", got)
+	}
+}
+
+// TestRecorderGolden tests that golden files don't depend on the order of arrival, and that
+// differences are reported.
+func TestRecorderGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exportertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "series.golden")
+
+	rec, exp := newRecordingExporter(t)
+	exp.ExportView(newViewData(testStart.Add(time.Minute), newRow("a", 1), newRow("b", 2)))
+	if err := exp.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := rec.CompareGolden(golden, true); err != nil {
+		t.Fatalf("updating golden file failed: %v", err)
+	}
+
+	rec2, exp2 := newRecordingExporter(t)
+	exp2.ExportView(newViewData(testStart.Add(time.Minute), newRow("b", 2), newRow("a", 1)))
+	if err := exp2.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := rec2.CompareGolden(golden, false); err != nil {
+		t.Errorf("series in different order mismatch golden file: %v", err)
+	}
+
+	rec3, exp3 := newRecordingExporter(t)
+	exp3.ExportView(newViewData(testStart.Add(time.Minute), newRow("a", 1), newRow("b", 3)))
+	if err := exp3.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := rec3.CompareGolden(golden, false); err == nil {
+		t.Error("series with different value match golden file")
+	}
+}
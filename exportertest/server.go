@@ -0,0 +1,342 @@
+// Package exportertest provides fakes and helpers for testing programs that export data with the
+// exporter, without access to stackdriver.
+package exportertest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	emptypb "github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/api/option"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MaxTimeSeriesPerRequest is the maximum number of time series in a request accepted by Server,
+// same as stackdriver.
+const MaxTimeSeriesPerRequest = 200
+
+// names of methods of Server, used for InjectErrors.
+const (
+	MethodCreateTimeSeries       = "CreateTimeSeries"
+	MethodCreateMetricDescriptor = "CreateMetricDescriptor"
+	MethodGetMetricDescriptor    = "GetMetricDescriptor"
+)
+
+// Server is an in-process fake of the metric service of stackdriver, listening on a local port.
+// It records accepted requests per project, and enforces rules of stackdriver on them: a request
+// has at most 200 time series without duplicates, each time series has a single point whose end
+// time is later than that of the previous point of the series, and each time series matches the
+// metric descriptor registered in the project, by AddMetricDescriptor or by RPC calls. Time series
+// breaking the rules are rejected, and others in the same request are accepted, with the error
+// message listing the failures just like stackdriver. A Server must be created by NewServer().
+type Server struct {
+	monitoringpb.UnimplementedMetricServiceServer
+
+	// Addr is the address that the server listens on.
+	Addr string
+	srv  *grpc.Server
+
+	// mu protects all fields below.
+	mu sync.Mutex
+	// reqs holds accepted requests to create time series per project. Rejected time series are
+	// removed from the requests.
+	reqs map[string][]*monitoringpb.CreateTimeSeriesRequest
+	// descs holds metric descriptors keyed by their resource names.
+	descs map[string]*metricpb.MetricDescriptor
+	// lastEnds holds end time of the last point of each time series, keyed by seriesKey().
+	lastEnds map[string]int64
+	// errs holds errors to be returned by each method, in order.
+	errs map[string][]error
+}
+
+// NewServer creates a Server and starts serving on a local port. Close() must be called when the
+// server is no longer used.
+func NewServer() (*Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	s := &Server{
+		Addr:     lis.Addr().String(),
+		srv:      grpc.NewServer(),
+		reqs:     make(map[string][]*monitoringpb.CreateTimeSeriesRequest),
+		descs:    make(map[string]*metricpb.MetricDescriptor),
+		lastEnds: make(map[string]int64),
+		errs:     make(map[string][]error),
+	}
+	monitoringpb.RegisterMetricServiceServer(s.srv, s)
+	go s.srv.Serve(lis)
+	return s, nil
+}
+
+// ClientOptions returns client options connecting to the server, which can be used as
+// ClientOptions of exporter options.
+func (s *Server) ClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(s.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Stop()
+}
+
+// AddMetricDescriptor registers the metric descriptor in the project.
+func (s *Server) AddMetricDescriptor(projectID string, desc *metricpb.MetricDescriptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.descs[descriptorName(projectID, desc.Type)] = desc
+}
+
+// InjectErrors makes calls to the method, one of MethodXxx constants, return errs in order before
+// processing requests. nil in errs lets the call be processed as usual.
+func (s *Server) InjectErrors(method string, errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs[method] = append(s.errs[method], errs...)
+}
+
+// Requests returns accepted requests to create time series of the project, in the order of
+// arrival. Rejected time series are removed from them.
+func (s *Server) Requests(projectID string) []*monitoringpb.CreateTimeSeriesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*monitoringpb.CreateTimeSeriesRequest(nil), s.reqs[projectID]...)
+}
+
+// TimeSeries returns all accepted time series of the project, in the order of arrival.
+func (s *Server) TimeSeries(projectID string) []*monitoringpb.TimeSeries {
+	var tsArr []*monitoringpb.TimeSeries
+	for _, req := range s.Requests(projectID) {
+		tsArr = append(tsArr, req.TimeSeries...)
+	}
+	return tsArr
+}
+
+// injectedError pops the error injected for the method. It must be called with mu held.
+func (s *Server) injectedError(method string) error {
+	errs := s.errs[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	s.errs[method] = errs[1:]
+	return errs[0]
+}
+
+// CreateTimeSeries implements monitoringpb.MetricServiceServer.
+func (s *Server) CreateTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.injectedError(MethodCreateTimeSeries); err != nil {
+		return nil, err
+	}
+	projectID, err := parseProjectName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.TimeSeries) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no time series in the request")
+	}
+	if MaxTimeSeriesPerRequest < len(req.TimeSeries) {
+		return nil, status.Errorf(codes.InvalidArgument, "number of time series %d exceeds the limit %d", len(req.TimeSeries), MaxTimeSeriesPerRequest)
+	}
+
+	// failures holds indices of rejected time series per cause.
+	failures := make(map[string][]int)
+	accepted := &monitoringpb.CreateTimeSeriesRequest{Name: req.Name}
+	seen := make(map[string]bool)
+	for i, ts := range req.TimeSeries {
+		key := seriesKey(ts)
+		cause := s.checkTimeSeries(projectID, ts, seen[key])
+		seen[key] = true
+		if cause != "" {
+			failures[cause] = append(failures[cause], i)
+			continue
+		}
+		end := ts.Points[0].Interval.EndTime
+		s.lastEnds[projectID+"\x00"+key] = end.Seconds*1e9 + int64(end.Nanos)
+		accepted.TimeSeries = append(accepted.TimeSeries, ts)
+	}
+	if len(accepted.TimeSeries) != 0 {
+		s.reqs[projectID] = append(s.reqs[projectID], accepted)
+	}
+	if len(failures) != 0 {
+		return nil, partialError(failures, len(req.TimeSeries))
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// checkTimeSeries checks ts of the project against rules of stackdriver, and returns the cause
+// of the failure, or empty string if ts is valid. duplicate tells whether the series of ts is
+// already in the request.
+func (s *Server) checkTimeSeries(projectID string, ts *monitoringpb.TimeSeries, duplicate bool) string {
+	if ts.Metric == nil || ts.Resource == nil {
+		return "Metric and resource must be set"
+	}
+	if duplicate {
+		return "Duplicate time series in the request"
+	}
+	if len(ts.Points) != 1 {
+		return "Time series must have exactly one point"
+	}
+	interval := ts.Points[0].Interval
+	if interval == nil || interval.EndTime == nil {
+		return "Point must have end time"
+	}
+	end, err := ptypes.Timestamp(interval.EndTime)
+	if err != nil {
+		return "Invalid end time"
+	}
+	if interval.StartTime != nil {
+		start, err := ptypes.Timestamp(interval.StartTime)
+		if err != nil || end.Before(start) {
+			return "Start time must not be later than end time"
+		}
+	}
+	if last, ok := s.lastEnds[projectID+"\x00"+seriesKey(ts)]; ok && end.UnixNano() <= last {
+		return "Points must be written in order. One or more of the points specified had an older end time than the most recent point"
+	}
+
+	desc, ok := s.descs[descriptorName(projectID, ts.Metric.Type)]
+	if !ok {
+		return fmt.Sprintf("Metric %s is not defined", ts.Metric.Type)
+	}
+	if ts.MetricKind != metricpb.MetricDescriptor_METRIC_KIND_UNSPECIFIED && ts.MetricKind != desc.MetricKind {
+		return fmt.Sprintf("Metric kind %v mismatches metric kind %v of the metric", ts.MetricKind, desc.MetricKind)
+	}
+	labelKeys := make(map[string]bool, len(desc.Labels))
+	for _, label := range desc.Labels {
+		labelKeys[label.Key] = true
+	}
+	for key := range ts.Metric.Labels {
+		if !labelKeys[key] {
+			return fmt.Sprintf("Unrecognized metric label %s", key)
+		}
+	}
+	return ""
+}
+
+// CreateMetricDescriptor implements monitoringpb.MetricServiceServer.
+func (s *Server) CreateMetricDescriptor(ctx context.Context, req *monitoringpb.CreateMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.injectedError(MethodCreateMetricDescriptor); err != nil {
+		return nil, err
+	}
+	projectID, err := parseProjectName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	desc := req.MetricDescriptor
+	if desc == nil || desc.Type == "" {
+		return nil, status.Error(codes.InvalidArgument, "metric descriptor must have metric type")
+	}
+	name := descriptorName(projectID, desc.Type)
+	if _, ok := s.descs[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "metric descriptor %s already exists", name)
+	}
+	desc = proto.Clone(desc).(*metricpb.MetricDescriptor)
+	desc.Name = name
+	s.descs[name] = desc
+	return desc, nil
+}
+
+// GetMetricDescriptor implements monitoringpb.MetricServiceServer.
+func (s *Server) GetMetricDescriptor(ctx context.Context, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.injectedError(MethodGetMetricDescriptor); err != nil {
+		return nil, err
+	}
+	desc, ok := s.descs[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "metric descriptor %s is not found", req.Name)
+	}
+	return desc, nil
+}
+
+// parseProjectName parses project ID from the resource name of the project.
+func parseProjectName(name string) (string, error) {
+	projectID := strings.TrimPrefix(name, "projects/")
+	if projectID == name || projectID == "" || strings.Contains(projectID, "/") {
+		return "", status.Errorf(codes.InvalidArgument, "invalid project name: %s", name)
+	}
+	return projectID, nil
+}
+
+func descriptorName(projectID, metricType string) string {
+	return fmt.Sprintf("projects/%s/metricDescriptors/%s", projectID, metricType)
+}
+
+// seriesKey identifies the time series of ts by its metric, resource and their labels.
+func seriesKey(ts *monitoringpb.TimeSeries) string {
+	var b strings.Builder
+	writeLabels := func(typ string, labels map[string]string) {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString(typ)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "\x00%s=%s", key, labels[key])
+		}
+		b.WriteString("\x01")
+	}
+	writeLabels(ts.GetMetric().GetType(), ts.GetMetric().GetLabels())
+	writeLabels(ts.GetResource().GetType(), ts.GetResource().GetLabels())
+	return b.String()
+}
+
+// partialError makes the error of a request with total time series whose time series are partially
+// rejected, in the form used by stackdriver: the status has a message listing failures, a
+// BadRequest detail with a field violation for each rejected time series, and a
+// CreateTimeSeriesSummary detail.
+func partialError(failures map[string][]int, total int) error {
+	causes := make([]string, 0, len(failures))
+	for cause := range failures {
+		causes = append(causes, cause)
+	}
+	sort.Strings(causes)
+	parts := make([]string, len(causes))
+	badReq := &errdetails.BadRequest{}
+	summary := &monitoringpb.CreateTimeSeriesSummary{TotalPointCount: int32(total)}
+	var failed int
+	for i, cause := range causes {
+		indices := make([]string, len(failures[cause]))
+		for j, idx := range failures[cause] {
+			indices[j] = fmt.Sprint(idx)
+			badReq.FieldViolations = append(badReq.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("timeSeries[%d]", idx),
+				Description: cause,
+			})
+		}
+		parts[i] = fmt.Sprintf("%s: timeSeries[%s]", cause, strings.Join(indices, ","))
+		summary.Errors = append(summary.Errors, &monitoringpb.CreateTimeSeriesSummary_Error{
+			Status:     &statuspb.Status{Code: int32(codes.InvalidArgument), Message: cause},
+			PointCount: int32(len(failures[cause])),
+		})
+		failed += len(failures[cause])
+	}
+	summary.SuccessPointCount = int32(total - failed)
+	st := status.Newf(codes.InvalidArgument, "One or more TimeSeries could not be written: %s", strings.Join(parts, "; "))
+	if detailed, err := st.WithDetails(badReq, summary); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
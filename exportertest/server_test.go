@@ -0,0 +1,157 @@
+package exportertest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	exporter "github.com/lychung83/stackdriver-exporter"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testProject      = "project-1"
+	testMetricPrefix = "custom.googleapis.com/opencensus"
+	testMetricType   = testMetricPrefix + "/test/count"
+)
+
+var (
+	testKey  = mustNewKey("key")
+	testView = &view.View{
+		Name:        "test/count",
+		Description: "count for test",
+		TagKeys:     []tag.Key{testKey},
+		Measure:     stats.Int64("test/count", "count for test", stats.UnitDimensionless),
+		Aggregation: view.Sum(),
+	}
+	testStart = time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func mustNewKey(name string) tag.Key {
+	key, err := tag.NewKey(name)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// errStorage collects errors reported to OnError.
+type errStorage struct {
+	mu   sync.Mutex
+	errs []error
+	rds  [][]*exporter.RowData
+}
+
+func (s *errStorage) onError(err error, rds ...*exporter.RowData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+	s.rds = append(s.rds, rds)
+}
+
+// newTestExporter creates an exporter connected to a new server, exporting all row data to
+// testProject with testMetricPrefix.
+func newTestExporter(t *testing.T, opts *exporter.Options) (*Server, *exporter.StatsExporter, *errStorage) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatalf("NewServer() failed: %v", err)
+	}
+	errStore := &errStorage{}
+	opts.ClientOptions = srv.ClientOptions()
+	opts.MetricPrefix = testMetricPrefix
+	opts.GetProjectID = func(*exporter.RowData) (string, error) { return testProject, nil }
+	opts.OnError = errStore.onError
+	exp, err := exporter.NewStatsExporter(context.Background(), opts)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("NewStatsExporter() failed: %v", err)
+	}
+	return srv, exp, errStore
+}
+
+func newViewData(end time.Time, rows ...*view.Row) *view.Data {
+	return &view.Data{View: testView, Start: testStart, End: end, Rows: rows}
+}
+
+func newRow(tagValue string, value float64) *view.Row {
+	return &view.Row{
+		Tags: []tag.Tag{{Key: testKey, Value: tagValue}},
+		Data: &view.SumData{Value: value},
+	}
+}
+
+// TestEndToEnd tests that the exporter creates metric descriptors and time series through the
+// real metric client, retrying injected errors.
+func TestEndToEnd(t *testing.T) {
+	srv, exp, errStore := newTestExporter(t, &exporter.Options{
+		CreateMetricDescriptors: true,
+		RetryMaxAttempts:        2,
+		RetryInitialBackoff:     time.Millisecond,
+	})
+	defer srv.Close()
+	srv.InjectErrors(MethodCreateTimeSeries, status.Error(codes.Unavailable, "try again"))
+
+	exp.ExportView(newViewData(testStart.Add(time.Minute), newRow("a", 1), newRow("b", 2)))
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() failed: %v", err)
+	}
+	if len(errStore.errs) != 0 {
+		t.Errorf("errors reported: %v", errStore.errs)
+	}
+
+	tsArr := srv.TimeSeries(testProject)
+	if len(tsArr) != 2 {
+		t.Fatalf("number of time series got: %d, want: 2", len(tsArr))
+	}
+	for i, wantValue := range []string{"a", "b"} {
+		ts := tsArr[i]
+		if ts.Metric.Type != testMetricType {
+			t.Errorf("metric type of %d-th time series got: %s, want: %s", i, ts.Metric.Type, testMetricType)
+		}
+		if got := ts.Metric.Labels["key"]; got != wantValue {
+			t.Errorf("label of %d-th time series got: %s, want: %s", i, got, wantValue)
+		}
+	}
+}
+
+// TestServerRules tests that time series breaking rules of stackdriver are rejected individually,
+// and reported to the exporter as partial failures.
+func TestServerRules(t *testing.T) {
+	srv, exp, errStore := newTestExporter(t, &exporter.Options{CreateMetricDescriptors: true})
+	defer srv.Close()
+	ctx := context.Background()
+
+	// Two points of the same series in a request.
+	exp.ExportView(newViewData(testStart.Add(2*time.Minute), newRow("a", 2)))
+	exp.ExportView(newViewData(testStart.Add(2*time.Minute), newRow("a", 2), newRow("b", 3)))
+	if err := exp.Flush(ctx); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+	// A point older than the last one.
+	exp.ExportView(newViewData(testStart.Add(time.Minute), newRow("a", 1)))
+	if err := exp.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() failed: %v", err)
+	}
+
+	wantCauses := []string{"Duplicate time series", "Points must be written in order"}
+	if len(errStore.errs) != len(wantCauses) {
+		t.Fatalf("number of errors got: %d, want: %d: %v", len(errStore.errs), len(wantCauses), errStore.errs)
+	}
+	for i, cause := range wantCauses {
+		if !strings.Contains(errStore.errs[i].Error(), cause) {
+			t.Errorf("%d-th error got: %v, want error containing %q", i, errStore.errs[i], cause)
+		}
+		if len(errStore.rds[i]) != 1 {
+			t.Errorf("number of row data of %d-th error got: %d, want: 1", i, len(errStore.rds[i]))
+		}
+	}
+	if got := len(srv.TimeSeries(testProject)); got != 2 {
+		t.Errorf("number of accepted time series got: %d, want: 2", got)
+	}
+}
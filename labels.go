@@ -0,0 +1,209 @@
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"go.opencensus.io/stats/view"
+)
+
+// limits on labels enforced by stackdriver.
+const (
+	maxLabelKeyLen   = 100
+	maxLabelValueLen = 1024
+
+	defaultMaxLabelsPerMetric = 30
+)
+
+// labelKeys returns sorted keys of labels that time series of v may have, before sanitization.
+func (e *StatsExporter) labelKeys(v *view.View) []string {
+	opts := e.opts
+	keySet := make(map[string]bool, len(opts.DefaultLabels)+len(v.TagKeys))
+	for key := range opts.DefaultLabels {
+		keySet[key] = true
+	}
+	for _, tagKey := range v.TagKeys {
+		keySet[tagKey.Name()] = true
+	}
+	for _, key := range opts.UnexportedLabels {
+		delete(keySet, key)
+	}
+
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	// Sort keys so that results do not depend on map iteration order.
+	sort.Strings(keys)
+	return keys
+}
+
+// exportedLabelKeys returns sorted keys of labels that time series of v may have, after
+// sanitization.
+func (e *StatsExporter) exportedLabelKeys(v *view.View) []string {
+	if !e.opts.SanitizeLabels {
+		return e.labelKeys(v)
+	}
+	keyMap := e.labelKeyMap(v)
+	keys := make([]string, 0, len(keyMap))
+	for _, key := range keyMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelKeyMap returns map from original label keys of v to sanitized label keys. Labels not in the
+// map are dropped. Maps are cached per view, so that all row data of a view are sanitized
+// consistently, and changes of label keys are reported only once per view.
+func (e *StatsExporter) labelKeyMap(v *view.View) map[string]string {
+	e.labelMu.Lock()
+	if keyMap, ok := e.labelKeyMaps[v]; ok {
+		e.labelMu.Unlock()
+		return keyMap
+	}
+
+	maxLabels := e.opts.MaxLabelsPerMetric
+	if maxLabels <= 0 {
+		maxLabels = defaultMaxLabelsPerMetric
+	}
+	var warnings []*Warning
+	warn := func(kind WarningKind, key, format string, args ...interface{}) {
+		warnings = append(warnings, &Warning{
+			Kind:    kind,
+			View:    v,
+			Label:   key,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	// Keys already valid go first, so that they win collisions with keys rewritten to them.
+	keys := e.labelKeys(v)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return sanitizeLabelKey(keys[i]) == keys[i] && sanitizeLabelKey(keys[j]) != keys[j]
+	})
+	keyMap := map[string]string{}
+	// origKeys maps sanitized keys to original keys, to detect collisions.
+	origKeys := map[string]string{}
+	for _, key := range keys {
+		newKey := sanitizeLabelKey(key)
+		if newKey != key {
+			warn(LabelKeyRewritten, key, "label key %q of view %s is rewritten to %q", key, v.Name, newKey)
+		}
+		if origKey, ok := origKeys[newKey]; ok {
+			warn(LabelKeyCollision, key, "label %q of view %s is dropped because its key collides with label %q", key, v.Name, origKey)
+			continue
+		}
+		if len(origKeys) == maxLabels {
+			warn(LabelDropped, key, "label %q of view %s is dropped because the view has more than %d labels", key, v.Name, maxLabels)
+			continue
+		}
+		origKeys[newKey] = key
+		keyMap[key] = newKey
+	}
+	e.labelKeyMaps[v] = keyMap
+	e.labelMu.Unlock()
+
+	// We report warnings outside of the lock, since OnWarning is provided by users.
+	for _, w := range warnings {
+		e.onWarning(w)
+	}
+	return keyMap
+}
+
+// sanitizeLabels sanitizes labels of rd made by makeLabels(), so that they satisfy limits of
+// stackdriver.
+func (e *StatsExporter) sanitizeLabels(rd *RowData, labels map[string]string) map[string]string {
+	keyMap := e.labelKeyMap(rd.View)
+	newLabels := make(map[string]string, len(labels))
+	for key, value := range labels {
+		newKey, ok := keyMap[key]
+		if !ok {
+			// Unless it's already reported by labelKeyMap(), the label is not from the view.
+			if !e.labelKeySet(rd.View)[key] && e.firstUnknownLabel(rd.View, key) {
+				e.onWarning(&Warning{
+					Kind:    LabelUnknown,
+					View:    rd.View,
+					RowData: rd,
+					Label:   key,
+					Message: fmt.Sprintf("label %q is dropped because it's not a tag key of view %s", key, rd.View.Name),
+				})
+			}
+			continue
+		}
+		if maxLabelValueLen < len(value) {
+			value = truncateLabelValue(value, e.opts.LabelValueTruncationSuffix)
+			e.onWarning(&Warning{
+				Kind:    LabelValueTruncated,
+				View:    rd.View,
+				RowData: rd,
+				Label:   key,
+				Message: fmt.Sprintf("value of label %q of view %s is truncated to %d bytes", key, rd.View.Name, maxLabelValueLen),
+			})
+		}
+		newLabels[newKey] = value
+	}
+	return newLabels
+}
+
+// firstUnknownLabel tells whether label key, which is not from v, is seen for the first time for
+// v. We use it to report such labels only once per view.
+func (e *StatsExporter) firstUnknownLabel(v *view.View, key string) bool {
+	e.labelMu.Lock()
+	defer e.labelMu.Unlock()
+	keys, ok := e.unknownLabels[v]
+	if !ok {
+		keys = map[string]bool{}
+		e.unknownLabels[v] = keys
+	}
+	if keys[key] {
+		return false
+	}
+	keys[key] = true
+	return true
+}
+
+// labelKeySet returns set of label keys of v before sanitization.
+func (e *StatsExporter) labelKeySet(v *view.View) map[string]bool {
+	keySet := map[string]bool{}
+	for _, key := range e.labelKeys(v) {
+		keySet[key] = true
+	}
+	return keySet
+}
+
+// sanitizeLabelKey rewrites key to be a valid label key, which consists of letters, digits and
+// underscores, starts with a letter, and is not longer than 100 characters.
+func sanitizeLabelKey(key string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if isLetter(r) || ('0' <= r && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+	if sanitized == "" || !isLetter(rune(sanitized[0])) {
+		sanitized = "key_" + sanitized
+	}
+	if maxLabelKeyLen < len(sanitized) {
+		sanitized = sanitized[:maxLabelKeyLen]
+	}
+	return sanitized
+}
+
+func isLetter(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+// truncateLabelValue truncates value with suffix so that the result is not longer than the limit,
+// without breaking UTF-8 encoding.
+func truncateLabelValue(value, suffix string) string {
+	if maxLabelValueLen < len(suffix) {
+		suffix = ""
+	}
+	end := maxLabelValueLen - len(suffix)
+	for 0 < end && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end] + suffix
+}
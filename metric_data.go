@@ -0,0 +1,238 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// ExportMetrics is the method called by opencensus metric readers to export metrics created by
+// metric API of opencensus. Each point of metrics is converted to a RowData, whose view describes
+// the metric, and whose row has labels of the time series as tags. Converted RowData go through
+// GetMetricProjectID or GetProjectID, MakeMetricResource, resource of the metric or MakeResource,
+// and per-project bundles in the same way as RowData made by ExportView(). Values of int64 points
+// are exported exactly, though row data hold them as float64. Gauge distributions and summaries
+// are not supported, and they are reported via OnError after being routed to their projects. All
+// errors are reported via OnError, so ExportMetrics always returns nil.
+func (e *StatsExporter) ExportMetrics(ctx context.Context, metrics []*metricdata.Metric) error {
+	for _, metric := range metrics {
+		for _, ts := range metric.TimeSeries {
+			for _, pt := range ts.Points {
+				rd, src, err := e.newMetricRowData(metric, ts, pt)
+				e.setMetricSource(rd, src)
+				if err != nil {
+					// Points not converted are reported only when they belong to a project.
+					if projID, ok := e.routeRowData(rd); ok {
+						newErr := fmt.Errorf("failed to convert point of metric %s for project %s: %v", metric.Descriptor.Name, projID, err)
+						e.onError(newErr, rd)
+						observability.RecordConversionFailure(e.ctx, projID)
+					}
+					e.forgetMetricSources(rd)
+					continue
+				}
+				if !e.exportRowData(rd) {
+					e.forgetMetricSources(rd)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// metricSource is the time series of metric API that a RowData is made from.
+type metricSource struct {
+	metric *metricdata.Metric
+	ts     *metricdata.TimeSeries
+	// int64Value is the value of an int64 point, which float64 in the row data may not hold
+	// exactly. isInt64 tells whether the point is int64.
+	int64Value int64
+	isInt64    bool
+}
+
+// setMetricSource keeps src of rd until forgetMetricSources() is called with rd.
+func (e *StatsExporter) setMetricSource(rd *RowData, src *metricSource) {
+	e.metricSourceMu.Lock()
+	defer e.metricSourceMu.Unlock()
+	e.metricSources[rd] = src
+}
+
+// metricSourceOf returns the time series of metric API that rd is made from, or nil for row data
+// of views.
+func (e *StatsExporter) metricSourceOf(rd *RowData) *metricSource {
+	e.metricSourceMu.Lock()
+	defer e.metricSourceMu.Unlock()
+	return e.metricSources[rd]
+}
+
+// forgetMetricSources forgets sources of rds, which are uploaded or dropped.
+func (e *StatsExporter) forgetMetricSources(rds ...*RowData) {
+	e.metricSourceMu.Lock()
+	defer e.metricSourceMu.Unlock()
+	for _, rd := range rds {
+		delete(e.metricSources, rd)
+	}
+}
+
+// fixValue replaces value made from the row data with the exact value of the point, if necessary.
+func (src *metricSource) fixValue(tv *monitoringpb.TypedValue) {
+	if _, ok := tv.Value.(*monitoringpb.TypedValue_Int64Value); ok && src.isInt64 {
+		tv.Value = &monitoringpb.TypedValue_Int64Value{Int64Value: src.int64Value}
+	}
+}
+
+// projectIDOf returns project ID of rd, with GetMetricProjectID for row data made by
+// ExportMetrics() when it's set, or with GetProjectID otherwise.
+func (e *StatsExporter) projectIDOf(rd *RowData) (string, error) {
+	if src := e.metricSourceOf(rd); src != nil && e.opts.GetMetricProjectID != nil {
+		return e.opts.GetMetricProjectID(src.metric, src.ts)
+	}
+	return e.getProjectID(rd)
+}
+
+// resourceOf returns monitored resource of rd. For row data made by ExportMetrics(),
+// MakeMetricResource or resource of the metric is used if possible. Otherwise MakeResource is used.
+func (e *StatsExporter) resourceOf(rd *RowData) (*monitoredrespb.MonitoredResource, error) {
+	if src := e.metricSourceOf(rd); src != nil {
+		if e.opts.MakeMetricResource != nil {
+			return e.opts.MakeMetricResource(src.metric, src.ts)
+		}
+		if res := src.metric.Resource; res != nil && res.Type != "" {
+			labels := make(map[string]string, len(res.Labels))
+			for key, value := range res.Labels {
+				labels[key] = value
+			}
+			return &monitoredrespb.MonitoredResource{Type: res.Type, Labels: labels}, nil
+		}
+	}
+	return e.makeResource(rd)
+}
+
+// newMetricRowData converts a point of metric to RowData, and returns it with its source. Even when
+// error is returned, RowData with invalid data is returned for error reporting.
+func (e *StatsExporter) newMetricRowData(metric *metricdata.Metric, ts *metricdata.TimeSeries, pt metricdata.Point) (*RowData, *metricSource, error) {
+	desc := metric.Descriptor
+	var bounds []float64
+	if dist, ok := pt.Value.(*metricdata.Distribution); ok && dist.BucketOptions != nil {
+		bounds = dist.BucketOptions.Bounds
+	}
+	v, viewErr := e.metricView(desc, bounds)
+	rd := &RowData{
+		View:  v,
+		Start: ts.StartTime,
+		End:   pt.Time,
+		Row:   &view.Row{},
+	}
+	src := &metricSource{metric: metric, ts: ts}
+	if viewErr != nil {
+		return rd, src, viewErr
+	}
+
+	for i, key := range v.TagKeys {
+		if i < len(ts.LabelValues) && ts.LabelValues[i].Present {
+			rd.Row.Tags = append(rd.Row.Tags, tag.Tag{Key: key, Value: ts.LabelValues[i].Value})
+		}
+	}
+	switch value := pt.Value.(type) {
+	case int64:
+		rd.Row.Data = newScalarData(v, float64(value))
+		src.int64Value, src.isInt64 = value, true
+	case float64:
+		rd.Row.Data = newScalarData(v, value)
+	case *metricdata.Distribution:
+		data := &view.DistributionData{
+			Count:           value.Count,
+			SumOfSquaredDev: value.SumOfSquaredDeviation,
+			CountPerBucket:  make([]int64, len(value.Buckets)),
+		}
+		if 0 < value.Count {
+			data.Mean = value.Sum / float64(value.Count)
+		}
+		for i, bucket := range value.Buckets {
+			data.CountPerBucket[i] = bucket.Count
+			if bucket.Exemplar != nil {
+				if data.ExemplarsPerBucket == nil {
+					data.ExemplarsPerBucket = make([]*metricdata.Exemplar, len(value.Buckets))
+				}
+				data.ExemplarsPerBucket[i] = bucket.Exemplar
+			}
+		}
+		rd.Row.Data = data
+	default:
+		return rd, src, fmt.Errorf("unsupported value type %T", pt.Value)
+	}
+	return rd, src, nil
+}
+
+// newScalarData makes aggregation data of non-distribution view v with value.
+func newScalarData(v *view.View, value float64) view.AggregationData {
+	if v.Aggregation.Type == view.AggTypeLastValue {
+		return &view.LastValueData{Value: value}
+	}
+	return &view.SumData{Value: value}
+}
+
+// cachedMetricView is a view describing a metric, made by metricView(). sig is the signature of
+// the metric that the view is made from.
+type cachedMetricView struct {
+	sig  string
+	view *view.View
+}
+
+// metricView returns the view describing the metric with desc, whose distribution has bounds.
+// Views are cached by metric names, so that the same view is used for all points of a metric, and
+// the cache doesn't grow beyond the number of metrics. When the type, label keys or bounds of the
+// metric change, a new view replaces the cached one. Even when error is returned, a view is
+// returned for error reporting.
+func (e *StatsExporter) metricView(desc metricdata.Descriptor, bounds []float64) (*view.View, error) {
+	e.metricViewMu.Lock()
+	defer e.metricViewMu.Unlock()
+	sig := fmt.Sprintf("%d/%v/%v", desc.Type, desc.LabelKeys, bounds)
+	if mv, ok := e.metricViews[desc.Name]; ok && mv.sig == sig {
+		return mv.view, nil
+	}
+
+	v := &view.View{
+		Name:        desc.Name,
+		Description: desc.Description,
+		Aggregation: view.LastValue(),
+	}
+	var err error
+	switch desc.Type {
+	case metricdata.TypeGaugeInt64:
+		v.Measure = stats.Int64(desc.Name, desc.Description, string(desc.Unit))
+	case metricdata.TypeGaugeFloat64:
+		v.Measure = stats.Float64(desc.Name, desc.Description, string(desc.Unit))
+	case metricdata.TypeCumulativeInt64:
+		v.Measure = stats.Int64(desc.Name, desc.Description, string(desc.Unit))
+		v.Aggregation = view.Sum()
+	case metricdata.TypeCumulativeFloat64:
+		v.Measure = stats.Float64(desc.Name, desc.Description, string(desc.Unit))
+		v.Aggregation = view.Sum()
+	case metricdata.TypeCumulativeDistribution:
+		v.Measure = stats.Float64(desc.Name, desc.Description, string(desc.Unit))
+		v.Aggregation = view.Distribution(bounds...)
+	default:
+		// We still need a measure for a valid view.
+		v.Measure = stats.Float64(desc.Name, desc.Description, string(desc.Unit))
+		err = fmt.Errorf("unsupported metric type %v", desc.Type)
+	}
+	for _, labelKey := range desc.LabelKeys {
+		key, keyErr := tag.NewKey(labelKey.Key)
+		if keyErr != nil {
+			return v, fmt.Errorf("invalid label key %s: %v", labelKey.Key, keyErr)
+		}
+		v.TagKeys = append(v.TagKeys, key)
+	}
+	if err != nil {
+		return v, err
+	}
+	e.metricViews[desc.Name] = &cachedMetricView{sig: sig, view: v}
+	return v, nil
+}
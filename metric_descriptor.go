@@ -0,0 +1,173 @@
+package exporter
+
+import (
+	"fmt"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// descResult holds the result of projectData.metricDescriptor().
+type descResult struct {
+	desc *metricpb.MetricDescriptor
+	err  error
+}
+
+// descCall is an in-flight RPC call getting or creating a metric descriptor, which is shared by
+// all callers asking for the same metric type meanwhile. done is closed when desc and err are set.
+type descCall struct {
+	done chan struct{}
+	desc *metricpb.MetricDescriptor
+	err  error
+}
+
+// metricDescriptor returns the metric descriptor of metricType, which is the metric type of view v,
+// in the project. If the descriptor is not cached, it is created by RPC call when
+// CreateMetricDescriptors option is set, or fetched by RPC call otherwise. The descriptor is cached
+// on success. RPC calls are made without holding pd.mu, and concurrent callers for the same metric
+// type wait for the same call.
+func (pd *projectData) metricDescriptor(v *view.View, metricType string) (*metricpb.MetricDescriptor, error) {
+	pd.mu.Lock()
+	if desc, ok := pd.descriptors[metricType]; ok {
+		pd.mu.Unlock()
+		return desc, nil
+	}
+	if call, ok := pd.descCalls[metricType]; ok {
+		pd.mu.Unlock()
+		<-call.done
+		return call.desc, call.err
+	}
+	call := &descCall{done: make(chan struct{})}
+	pd.descCalls[metricType] = call
+	pd.mu.Unlock()
+
+	call.desc, call.err = pd.fetchMetricDescriptor(v, metricType)
+
+	pd.mu.Lock()
+	delete(pd.descCalls, metricType)
+	if call.err == nil {
+		pd.descriptors[metricType] = call.desc
+	}
+	pd.mu.Unlock()
+	close(call.done)
+	return call.desc, call.err
+}
+
+// fetchMetricDescriptor creates or gets the metric descriptor of metricType by RPC call, as
+// designated by CreateMetricDescriptors option.
+func (pd *projectData) fetchMetricDescriptor(v *view.View, metricType string) (*metricpb.MetricDescriptor, error) {
+	if pd.parent.opts.CreateMetricDescriptors {
+		desc, err := pd.createMetricDescriptor(v, metricType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create metric descriptor of view %s for project %s: %v", v.Name, pd.projectID, err)
+		}
+		return desc, nil
+	}
+	desc, err := pd.getMetricDescriptor(metricType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metric descriptor of view %s for project %s: %v", v.Name, pd.projectID, err)
+	}
+	return desc, nil
+}
+
+// createMetricDescriptor creates metric descriptor of metricType for view v in the project. When the
+// metric already exists, the descriptor in the project is fetched instead, since it may differ from
+// the one made from v.
+func (pd *projectData) createMetricDescriptor(v *view.View, metricType string) (*metricpb.MetricDescriptor, error) {
+	exp := pd.parent
+	desc := exp.newMetricDescriptor(v, pd.projectID, metricType)
+	req := &monitoringpb.CreateMetricDescriptorRequest{
+		Name:             fmt.Sprintf("projects/%s", pd.projectID),
+		MetricDescriptor: desc,
+	}
+	client, err := pd.metricClient()
+	if err != nil {
+		return nil, err
+	}
+	created, err := client.CreateMetricDescriptor(exp.ctx, req)
+	switch {
+	case err == nil:
+		return created, nil
+	case status.Code(err) == codes.AlreadyExists:
+		// Someone else created the metric in the meantime, which is fine for us as long as we
+		// use what's really in the project.
+		return pd.getMetricDescriptor(metricType)
+	default:
+		return nil, err
+	}
+}
+
+// getMetricDescriptor fetches metric descriptor of metricType from the project.
+func (pd *projectData) getMetricDescriptor(metricType string) (*metricpb.MetricDescriptor, error) {
+	exp := pd.parent
+	req := &monitoringpb.GetMetricDescriptorRequest{
+		Name: fmt.Sprintf("projects/%s/metricDescriptors/%s", pd.projectID, metricType),
+	}
+	client, err := pd.metricClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetMetricDescriptor(exp.ctx, req)
+}
+
+// newMetricDescriptor constructs metric descriptor of the stackdriver metric of metricType
+// corresponding to v.
+func (e *StatsExporter) newMetricDescriptor(v *view.View, projectID, metricType string) *metricpb.MetricDescriptor {
+	return &metricpb.MetricDescriptor{
+		Name:        fmt.Sprintf("projects/%s/metricDescriptors/%s", projectID, metricType),
+		Type:        metricType,
+		DisplayName: v.Name,
+		Description: v.Description,
+		Unit:        metricUnit(v),
+		MetricKind:  e.metricKind(v),
+		ValueType:   valueType(v),
+		Labels:      e.labelDescriptors(v),
+	}
+}
+
+// metricUnit returns unit of the metric corresponding to v.
+func metricUnit(v *view.View) string {
+	if v.Aggregation.Type == view.AggTypeCount {
+		// Count is dimensionless regardless of measure's unit.
+		return stats.UnitDimensionless
+	}
+	return v.Measure.Unit()
+}
+
+// valueType returns value type of the metric corresponding to v. It must be consistent with
+// newTypedValue().
+func valueType(v *view.View) metricpb.MetricDescriptor_ValueType {
+	switch v.Aggregation.Type {
+	case view.AggTypeCount:
+		return metricpb.MetricDescriptor_INT64
+	case view.AggTypeDistribution:
+		return metricpb.MetricDescriptor_DISTRIBUTION
+	}
+	switch v.Measure.(type) {
+	case *stats.Int64Measure:
+		return metricpb.MetricDescriptor_INT64
+	case *stats.Float64Measure:
+		return metricpb.MetricDescriptor_DOUBLE
+	default:
+		return metricpb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED
+	}
+}
+
+// labelDescriptors returns descriptors of labels that time series of v may have. It must be
+// consistent with makeLabels().
+func (e *StatsExporter) labelDescriptors(v *view.View) []*labelpb.LabelDescriptor {
+	keys := e.exportedLabelKeys(v)
+	labels := make([]*labelpb.LabelDescriptor, len(keys))
+	for i, key := range keys {
+		labels[i] = &labelpb.LabelDescriptor{
+			Key:       key,
+			ValueType: labelpb.LabelDescriptor_STRING,
+		}
+	}
+	return labels
+}
@@ -0,0 +1,240 @@
+package exporter
+
+import (
+	"fmt"
+	"time"
+
+	timestamppb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"go.opencensus.io/stats/view"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// metricKind returns kind of the metric corresponding to v. It must be consistent with newPoint()
+// and convertPoint().
+func (e *StatsExporter) metricKind(v *view.View) metricpb.MetricDescriptor_MetricKind {
+	if v.Aggregation.Type == view.AggTypeLastValue {
+		return metricpb.MetricDescriptor_GAUGE
+	}
+	if kind, ok := e.opts.MetricKinds[v.Name]; ok {
+		return kind
+	}
+	return metricpb.MetricDescriptor_CUMULATIVE
+}
+
+// checkMetricKinds checks that MetricKinds option has only valid metric kinds.
+func checkMetricKinds(kinds map[string]metricpb.MetricDescriptor_MetricKind) error {
+	for name, kind := range kinds {
+		switch kind {
+		case metricpb.MetricDescriptor_CUMULATIVE, metricpb.MetricDescriptor_DELTA, metricpb.MetricDescriptor_GAUGE:
+		default:
+			return fmt.Errorf("invalid metric kind %v of view %s", kind, name)
+		}
+	}
+	return nil
+}
+
+// tracksSeries tells whether points of rd are converted against the state of their series kept
+// in the tracker.
+func (pd *projectData) tracksSeries(rd *RowData) bool {
+	if pd.tracker == nil {
+		return false
+	}
+	switch pd.parent.metricKind(rd.View) {
+	case metricpb.MetricDescriptor_DELTA:
+		return true
+	case metricpb.MetricDescriptor_CUMULATIVE:
+		return pd.parent.opts.TrackCumulative
+	default:
+		return false
+	}
+}
+
+// convertPoint converts the cumulative point of ts made from rd to the metric kind of the view.
+// key is the key of the series when it's tracked, and empty otherwise. It returns the state of the
+// series after the point is exported, which is nil for series not tracked, and must be committed
+// to the tracker only after the point is exported successfully. It returns false when the point
+// must not be exported.
+func (pd *projectData) convertPoint(rd *RowData, ts *monitoringpb.TimeSeries, key string) (*seriesState, bool) {
+	kind := pd.parent.metricKind(rd.View)
+	if kind == metricpb.MetricDescriptor_GAUGE {
+		ts.Points[0].Interval.StartTime = nil
+		return nil, true
+	}
+	if key == "" {
+		return nil, true
+	}
+	var state *seriesState
+	var ok bool
+	if kind == metricpb.MetricDescriptor_DELTA {
+		state, ok = pd.toDelta(rd, ts, key, pd.tracker.get(key))
+	} else {
+		state, ok = pd.trackCumulative(rd, ts, pd.tracker.get(key))
+	}
+	if state != nil {
+		state.key = key
+	}
+	return state, ok
+}
+
+// toDelta converts the cumulative point of ts made from rd to the delta from last, the state of
+// the series of key. The first point of a series is not exported, but committed to the tracker
+// right away as the base of the next delta. After a reset, the whole value of the point is the
+// delta.
+func (pd *projectData) toDelta(rd *RowData, ts *monitoringpb.TimeSeries, key string, last *seriesState) (*seriesState, bool) {
+	exp := pd.parent
+	pt := ts.Points[0]
+	cumulative := pt.Value
+	start, end := rd.Start, rd.End
+	if last == nil {
+		pd.tracker.commit(&seriesState{key: key, rawStart: rd.Start, start: start, end: end, value: cumulative})
+		observability.RecordRows(exp.ctx, pd.projectID, observability.OutcomeDeltaBase, 1)
+		return nil, false
+	}
+	if !last.end.Before(end) {
+		exp.onWarning(&Warning{
+			Kind:    CumulativeOutOfOrder,
+			View:    rd.View,
+			RowData: rd,
+			Message: fmt.Sprintf("point of metric %s ending at %v is not later than the last point ending at %v, so it is dropped", ts.Metric.Type, end, last.end),
+		})
+		return nil, false
+	}
+
+	delta, valid := deltaValue(cumulative, last.value)
+	if !valid || last.rawStart.Before(rd.Start) {
+		exp.onWarning(&Warning{
+			Kind:    CumulativeReset,
+			View:    rd.View,
+			RowData: rd,
+			Message: fmt.Sprintf("metric %s is reset with start time %v", ts.Metric.Type, rd.Start),
+		})
+		delta = resetDelta(cumulative)
+		if start.Before(last.end) {
+			start = last.end
+		}
+	} else {
+		start = last.end
+	}
+	pt.Value = delta
+	pt.Interval.StartTime = &timestamppb.Timestamp{
+		Seconds: start.Unix(),
+		Nanos:   int32(start.Nanosecond()),
+	}
+	if dist, isDist := pt.Value.Value.(*monitoringpb.TypedValue_DistributionValue); isDist {
+		filterExemplars(dist.DistributionValue, start)
+	}
+	return &seriesState{rawStart: rd.Start, start: start, end: end, value: cumulative}, true
+}
+
+// resetDelta returns the delta of a point after a reset, which is the whole cumulative value. A
+// distribution is copied without its range like other deltas, so that filtering exemplars of the
+// delta doesn't change cumulative kept in the tracker.
+func resetDelta(cumulative *monitoringpb.TypedValue) *monitoringpb.TypedValue {
+	dist, ok := cumulative.Value.(*monitoringpb.TypedValue_DistributionValue)
+	if !ok {
+		return cumulative
+	}
+	cur := dist.DistributionValue
+	return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{
+		DistributionValue: &distributionpb.Distribution{
+			Count:                 cur.Count,
+			Mean:                  cur.Mean,
+			SumOfSquaredDeviation: cur.SumOfSquaredDeviation,
+			BucketOptions:         cur.BucketOptions,
+			BucketCounts:          cur.BucketCounts,
+			Exemplars:             cur.Exemplars,
+		},
+	}}
+}
+
+// deltaValue returns cur - last of cumulative values. valid is false when cur is less than last,
+// which means that the series is reset.
+func deltaValue(cur, last *monitoringpb.TypedValue) (delta *monitoringpb.TypedValue, valid bool) {
+	switch c := cur.Value.(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		l, ok := last.Value.(*monitoringpb.TypedValue_Int64Value)
+		if !ok || c.Int64Value < l.Int64Value {
+			return nil, false
+		}
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{
+			Int64Value: c.Int64Value - l.Int64Value,
+		}}, true
+	case *monitoringpb.TypedValue_DoubleValue:
+		l, ok := last.Value.(*monitoringpb.TypedValue_DoubleValue)
+		if !ok || c.DoubleValue < l.DoubleValue {
+			return nil, false
+		}
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{
+			DoubleValue: c.DoubleValue - l.DoubleValue,
+		}}, true
+	case *monitoringpb.TypedValue_DistributionValue:
+		l, ok := last.Value.(*monitoringpb.TypedValue_DistributionValue)
+		if !ok {
+			return nil, false
+		}
+		dist, ok := deltaDistribution(c.DistributionValue, l.DistributionValue)
+		if !ok {
+			return nil, false
+		}
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{
+			DistributionValue: dist,
+		}}, true
+	default:
+		return nil, false
+	}
+}
+
+// deltaDistribution returns the distribution of values added to last to make cur. ok is false
+// when cur can't be made from last, which means that the series is reset.
+func deltaDistribution(cur, last *distributionpb.Distribution) (*distributionpb.Distribution, bool) {
+	if distributionReset(cur, last) {
+		return nil, false
+	}
+	bucketCounts := make([]int64, len(cur.BucketCounts))
+	for i := range bucketCounts {
+		bucketCounts[i] = cur.BucketCounts[i] - last.BucketCounts[i]
+	}
+
+	delta := &distributionpb.Distribution{
+		Count:         cur.Count - last.Count,
+		BucketOptions: cur.BucketOptions,
+		BucketCounts:  bucketCounts,
+		// Range of the delta can't be known, so it's not exported.
+		Exemplars: cur.Exemplars,
+	}
+	if delta.Count == 0 {
+		return delta, true
+	}
+	// cur is the union of last and delta. With n, m and s being count, mean and sum of squared
+	// deviation, the union satisfies
+	//   n = n1 + n2
+	//   m = (n1*m1 + n2*m2) / n
+	//   s = s1 + s2 + n1*n2/n * (m1 - m2)^2
+	// so we solve them for the delta.
+	n, n1, n2 := float64(cur.Count), float64(last.Count), float64(delta.Count)
+	delta.Mean = (n*cur.Mean - n1*last.Mean) / n2
+	diff := last.Mean - delta.Mean
+	delta.SumOfSquaredDeviation = cur.SumOfSquaredDeviation - last.SumOfSquaredDeviation - n1*n2/n*diff*diff
+	// Rounding errors must not make it negative.
+	if delta.SumOfSquaredDeviation < 0 {
+		delta.SumOfSquaredDeviation = 0
+	}
+	return delta, true
+}
+
+// filterExemplars removes exemplars of dist recorded before start, which don't belong to the
+// interval of the delta.
+func filterExemplars(dist *distributionpb.Distribution, start time.Time) {
+	var exemplars []*distributionpb.Distribution_Exemplar
+	for _, exemplar := range dist.Exemplars {
+		ts := exemplar.Timestamp
+		if ts != nil && time.Unix(ts.Seconds, int64(ts.Nanos)).Before(start) {
+			continue
+		}
+		exemplars = append(exemplars, exemplar)
+	}
+	dist.Exemplars = exemplars
+}
@@ -0,0 +1,35 @@
+package exporter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// metricTypeRegexp matches valid metric types, which consist of a domain name and a path, like
+// "custom.googleapis.com/opencensus/latency".
+var metricTypeRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+(/[A-Za-z0-9_.-]+)+$`)
+
+// metricType returns stackdriver metric type of rd for the project, as designated by MetricTypeFunc
+// or MetricPrefix option. When neither option is set, the name of the view is used as it is.
+// Metric types made by the options are validated, and invalid ones are returned as errors.
+func (pd *projectData) metricType(rd *RowData) (string, error) {
+	opts := pd.parent.opts
+	var metricType string
+	switch {
+	case opts.MetricTypeFunc != nil:
+		metricType = opts.MetricTypeFunc(rd, pd.projectID)
+	case opts.MetricPrefix != "":
+		metricType = opts.MetricPrefix
+		if !strings.HasSuffix(metricType, "/") {
+			metricType += "/"
+		}
+		metricType += rd.View.Name
+	default:
+		return rd.View.Name, nil
+	}
+	if !metricTypeRegexp.MatchString(metricType) {
+		return "", fmt.Errorf("invalid metric type %q of view %s for project %s", metricType, rd.View.Name, pd.projectID)
+	}
+	return metricType, nil
+}
@@ -3,13 +3,22 @@ package exporter
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	gax "github.com/googleapis/gax-go"
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/api/option"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	cloudtracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // This file defines various mocks for testing, and checking functions for mocked data. We mock
@@ -18,6 +27,14 @@ import (
 func init() {
 	newMetricClient = mockNewMetricClient
 	newExpBundler = mockNewExpBundler
+	retrySleep = mockRetrySleep
+	newTraceClient = mockNewTraceClient
+	newSpanBundler = mockNewSpanBundler
+}
+
+// We don't want to wait between retries in tests.
+func mockRetrySleep(_ context.Context, _ time.Duration) error {
+	return nil
 }
 
 // We define mock Client.
@@ -29,6 +46,15 @@ type mockMetricClient struct {
 	returnErrs []error
 	// reqs saves all incoming requests.
 	reqs []*monitoringpb.CreateTimeSeriesRequest
+	// descReturnErrs and descReqs are counterparts of returnErrs and reqs for
+	// CreateMetricDescriptor() calls.
+	descReturnErrs []error
+	descReqs       []*monitoringpb.CreateMetricDescriptorRequest
+	// descs holds metric descriptors returned by GetMetricDescriptor(), keyed by resource name of
+	// metric descriptors.
+	descs map[string]*metricpb.MetricDescriptor
+	// closed is set by Close().
+	closed bool
 }
 
 func (cl *mockMetricClient) CreateTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest, opts ...gax.CallOption) error {
@@ -43,7 +69,29 @@ func (cl *mockMetricClient) CreateTimeSeries(ctx context.Context, req *monitorin
 	return err
 }
 
+func (cl *mockMetricClient) CreateMetricDescriptor(ctx context.Context, req *monitoringpb.CreateMetricDescriptorRequest, opts ...gax.CallOption) (*metricpb.MetricDescriptor, error) {
+	cl.descReqs = append(cl.descReqs, req)
+	if len(cl.descReturnErrs) == 0 {
+		return req.MetricDescriptor, nil
+	}
+	err := cl.descReturnErrs[0]
+	cl.descReturnErrs = cl.descReturnErrs[1:]
+	if err != nil {
+		return nil, err
+	}
+	return req.MetricDescriptor, nil
+}
+
+func (cl *mockMetricClient) GetMetricDescriptor(ctx context.Context, req *monitoringpb.GetMetricDescriptorRequest, opts ...gax.CallOption) (*metricpb.MetricDescriptor, error) {
+	desc, ok := cl.descs[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "metric descriptor %s not found", req.Name)
+	}
+	return desc, nil
+}
+
 func (cl *mockMetricClient) Close() error {
+	cl.closed = true
 	return nil
 }
 
@@ -51,6 +99,20 @@ func (cl *mockMetricClient) addReturnErrs(errs ...error) {
 	cl.returnErrs = append(cl.returnErrs, errs...)
 }
 
+func (cl *mockMetricClient) addDescReturnErrs(errs ...error) {
+	cl.descReturnErrs = append(cl.descReturnErrs, errs...)
+}
+
+// addDescs registers metric descriptors of the project to be returned by GetMetricDescriptor().
+func (cl *mockMetricClient) addDescs(projectID string, descs ...*metricpb.MetricDescriptor) {
+	if cl.descs == nil {
+		cl.descs = map[string]*metricpb.MetricDescriptor{}
+	}
+	for _, desc := range descs {
+		cl.descs[fmt.Sprintf("projects/%s/metricDescriptors/%s", projectID, desc.Type)] = desc
+	}
+}
+
 func mockNewMetricClient(_ context.Context, _ ...option.ClientOption) (metricClient, error) {
 	return &mockMetricClient{}, nil
 }
@@ -90,19 +152,96 @@ func checkMetricClient(t *testing.T, cl *mockMetricClient, wantReqsValues [][]in
 type mockBundler struct {
 	// rowDataArr saves all incoming RowData to the bundler.
 	rowDataArr []*RowData
+	// flushCount counts calls to Flush().
+	flushCount int
+	// addErr is returned by Add() when set, in which case row data is not saved.
+	addErr error
+	// addWaitErr is returned by AddWait() when set, in which case row data is not saved.
+	addWaitErr error
+	// onAddWait is called by AddWait() with its arguments when set, to simulate what happens
+	// while row data waits for room.
+	onAddWait func(ctx context.Context, rd *RowData)
+	// flushBlock blocks Flush() until it's closed, when set.
+	flushBlock chan struct{}
 }
 
 func (b *mockBundler) Add(rowData interface{}, _ int) error {
+	if b.addErr != nil {
+		return b.addErr
+	}
 	b.rowDataArr = append(b.rowDataArr, rowData.(*RowData))
 	return nil
 }
 
-func (b *mockBundler) Flush() {}
+// AddWait adds row data regardless of addErr, since room is assumed to be made while waiting.
+func (b *mockBundler) AddWait(ctx context.Context, rowData interface{}, _ int) error {
+	if b.onAddWait != nil {
+		b.onAddWait(ctx, rowData.(*RowData))
+	}
+	if b.addWaitErr != nil {
+		return b.addWaitErr
+	}
+	b.rowDataArr = append(b.rowDataArr, rowData.(*RowData))
+	return nil
+}
 
-func mockNewExpBundler(_ func(interface{}), _ time.Duration, _ int) expBundler {
+func (b *mockBundler) Flush() {
+	b.flushCount++
+	if b.flushBlock != nil {
+		<-b.flushBlock
+	}
+}
+
+func mockNewExpBundler(_ func(interface{}), _ *Options) expBundler {
 	return &mockBundler{}
 }
 
+// We define mock trace client and span bundler, which are counterparts of mock metric client and
+// mock bundler.
+
+type mockTraceClient struct {
+	returnErrs []error
+	reqs       []*cloudtracepb.BatchWriteSpansRequest
+}
+
+func (cl *mockTraceClient) BatchWriteSpans(ctx context.Context, req *cloudtracepb.BatchWriteSpansRequest, opts ...gax.CallOption) error {
+	cl.reqs = append(cl.reqs, req)
+	if len(cl.returnErrs) == 0 {
+		return nil
+	}
+	err := cl.returnErrs[0]
+	cl.returnErrs = cl.returnErrs[1:]
+	return err
+}
+
+func (cl *mockTraceClient) Close() error {
+	return nil
+}
+
+func mockNewTraceClient(_ context.Context, _ ...option.ClientOption) (traceClient, error) {
+	return &mockTraceClient{}, nil
+}
+
+type mockSpanBundler struct {
+	spanDataArr []*trace.SpanData
+	// addErr is returned by Add() when set, and the span data is not added.
+	addErr error
+}
+
+func (b *mockSpanBundler) Add(spanData interface{}, _ int) error {
+	if b.addErr != nil {
+		return b.addErr
+	}
+	b.spanDataArr = append(b.spanDataArr, spanData.(*trace.SpanData))
+	return nil
+}
+
+func (b *mockSpanBundler) Flush() {}
+
+func mockNewSpanBundler(_ func(interface{}), _ time.Duration, _ int) spanBundler {
+	return &mockSpanBundler{}
+}
+
 // We define a storage for all errors happened in export operation.
 
 type errStorage struct {
@@ -243,3 +382,54 @@ func checkLabels(t *testing.T, prefix string, labels, wantLabels map[string]stri
 		}
 	}
 }
+
+// registerObservabilityViews registers views of the exporter's own measures. The returned
+// function unregisters them, which discards their data, so that tests don't see data recorded by
+// each other.
+func registerObservabilityViews(t *testing.T) func() {
+	if err := view.Register(observability.DefaultViews...); err != nil {
+		t.Fatalf("registering observability views failed: %v", err)
+	}
+	return func() { view.Unregister(observability.DefaultViews...) }
+}
+
+// observedData returns aggregation data of the row of the view with exactly given tags, or nil
+// with an error reported when there's no such row.
+func observedData(t *testing.T, v *view.View, tags map[tag.Key]string) view.AggregationData {
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatalf("retrieving data of view %s failed: %v", v.Name, err)
+	}
+	for _, row := range rows {
+		rowTags := make(map[tag.Key]string, len(row.Tags))
+		for _, rowTag := range row.Tags {
+			rowTags[rowTag.Key] = rowTag.Value
+		}
+		if reflect.DeepEqual(rowTags, tags) {
+			return row.Data
+		}
+	}
+	t.Errorf("view %s has no row with tags %v, rows: %v", v.Name, tags, rows)
+	return nil
+}
+
+// checkObservedCount checks that the row of the view with given tags has aggregated count
+// measurements, or their sum for views of sum aggregation.
+func checkObservedCount(t *testing.T, v *view.View, tags map[tag.Key]string, count int64) {
+	var got int64
+	switch data := observedData(t, v, tags).(type) {
+	case nil:
+		return
+	case *view.CountData:
+		got = data.Value
+	case *view.SumData:
+		got = int64(data.Value)
+	case *view.DistributionData:
+		got = data.Count
+	default:
+		t.Fatalf("unexpected aggregation data %T of view %s", data, v.Name)
+	}
+	if got != count {
+		t.Errorf("count of view %s with tags %v got: %d, want: %d", v.Name, tags, got, count)
+	}
+}
@@ -0,0 +1,205 @@
+// Package observability defines measures and views for observing behavior of the exporter itself.
+// Register views in DefaultViews to collect them. The exporter doesn't export data of these
+// measures to GCP projects unless Options.ExportSelfObservability is set, so these data should be
+// exported by other exporters usually.
+package observability
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+)
+
+// prefix of names of all measures and views defined in this package.
+const namePrefix = "stackdriver_exporter/"
+
+// outcomes of row data passed to the exporter.
+const (
+	// OutcomeAccepted means that row data is added to the bundle of its project.
+	OutcomeAccepted = "accepted"
+	// OutcomeNotApplicable means that row data is not applicable to the exporter.
+	OutcomeNotApplicable = "not_applicable"
+	// OutcomeProjectIDError means that project ID of row data couldn't be determined.
+	OutcomeProjectIDError = "project_id_error"
+	// OutcomeDropped means that row data couldn't be added to the bundle of its project, or that
+	// it was dropped from the bundle to make room for newer row data.
+	OutcomeDropped = "dropped"
+	// OutcomeDeltaBase means that row data was the first point of a series of DELTA metric
+	// kind, which is kept as the base of the next delta instead of being uploaded.
+	OutcomeDeltaBase = "delta_base"
+)
+
+// actions taken on requests exceeding rate limits of their projects.
+const (
+	// ThrottleDelayed means that the request waited for the rate limit before uploading.
+	ThrottleDelayed = "delayed"
+	// ThrottleDropped means that the request was dropped without uploading.
+	ThrottleDropped = "dropped"
+)
+
+// tag keys used by measures.
+var (
+	// KeyProjectID is GCP project ID of row data. It is empty when project ID is not known.
+	KeyProjectID = mustNewKey("project_id")
+	// KeyOutcome is one of outcomes of row data, like OutcomeAccepted.
+	KeyOutcome = mustNewKey("outcome")
+	// KeyCode is gRPC code of RPC calls, like "OK" or "UNAVAILABLE".
+	KeyCode = mustNewKey("code")
+	// KeyThrottle is the action taken on requests exceeding rate limits, like ThrottleDelayed.
+	KeyThrottle = mustNewKey("throttle")
+)
+
+// measures recorded by the exporter.
+var (
+	Rows               = stats.Int64(namePrefix+"rows", "Number of row data passed to the exporter", stats.UnitDimensionless)
+	ConversionFailures = stats.Int64(namePrefix+"conversion_failures", "Number of row data failed to be converted to time series", stats.UnitDimensionless)
+	RPCLatency         = stats.Float64(namePrefix+"rpc_latency", "Latency of RPC calls to create time series", stats.UnitMilliseconds)
+	BundleSize         = stats.Int64(namePrefix+"bundle_size", "Number of row data in bundles being uploaded", stats.UnitDimensionless)
+	BundlerOverflows   = stats.Int64(namePrefix+"bundler_overflows", "Number of row data failed to be added to bundles", stats.UnitDimensionless)
+	ThrottleDelay      = stats.Float64(namePrefix+"throttle_delay", "Time that requests exceeding rate limits waited before uploading", stats.UnitMilliseconds)
+)
+
+// views of measures.
+var (
+	RowsView = &view.View{
+		Name:        namePrefix + "rows",
+		Description: Rows.Description(),
+		TagKeys:     []tag.Key{KeyProjectID, KeyOutcome},
+		Measure:     Rows,
+		Aggregation: view.Sum(),
+	}
+	ConversionFailuresView = &view.View{
+		Name:        namePrefix + "conversion_failures",
+		Description: ConversionFailures.Description(),
+		TagKeys:     []tag.Key{KeyProjectID},
+		Measure:     ConversionFailures,
+		Aggregation: view.Sum(),
+	}
+	RPCLatencyView = &view.View{
+		Name:        namePrefix + "rpc_latency",
+		Description: RPCLatency.Description(),
+		TagKeys:     []tag.Key{KeyProjectID, KeyCode},
+		Measure:     RPCLatency,
+		Aggregation: view.Distribution(0, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000),
+	}
+	RPCCountView = &view.View{
+		Name:        namePrefix + "rpc_count",
+		Description: "Number of RPC calls to create time series",
+		TagKeys:     []tag.Key{KeyProjectID, KeyCode},
+		Measure:     RPCLatency,
+		Aggregation: view.Count(),
+	}
+	BundleSizeView = &view.View{
+		Name:        namePrefix + "bundle_size",
+		Description: BundleSize.Description(),
+		TagKeys:     []tag.Key{KeyProjectID},
+		Measure:     BundleSize,
+		Aggregation: view.Distribution(0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000),
+	}
+	BundlerOverflowsView = &view.View{
+		Name:        namePrefix + "bundler_overflows",
+		Description: BundlerOverflows.Description(),
+		TagKeys:     []tag.Key{KeyProjectID},
+		Measure:     BundlerOverflows,
+		Aggregation: view.Sum(),
+	}
+	ThrottleDelayView = &view.View{
+		Name:        namePrefix + "throttle_delay",
+		Description: ThrottleDelay.Description(),
+		TagKeys:     []tag.Key{KeyProjectID, KeyThrottle},
+		Measure:     ThrottleDelay,
+		Aggregation: view.Distribution(0, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000),
+	}
+	ThrottledRequestsView = &view.View{
+		Name:        namePrefix + "throttled_requests",
+		Description: "Number of requests delayed or dropped by rate limits",
+		TagKeys:     []tag.Key{KeyProjectID, KeyThrottle},
+		Measure:     ThrottleDelay,
+		Aggregation: view.Count(),
+	}
+
+	// DefaultViews contains all views defined in this package.
+	DefaultViews = []*view.View{
+		RowsView,
+		ConversionFailuresView,
+		RPCLatencyView,
+		RPCCountView,
+		BundleSizeView,
+		BundlerOverflowsView,
+		ThrottleDelayView,
+		ThrottledRequestsView,
+	}
+)
+
+func mustNewKey(name string) tag.Key {
+	key, err := tag.NewKey(name)
+	if err != nil {
+		panic(fmt.Errorf("key creation failed for key name: %s", name))
+	}
+	return key
+}
+
+// IsExporterView tells whether v aggregates a measure defined in this package.
+func IsExporterView(v *view.View) bool {
+	return strings.HasPrefix(v.Measure.Name(), namePrefix)
+}
+
+// RecordRows records n row data of the project with given outcome.
+func RecordRows(ctx context.Context, projectID, outcome string, n int) {
+	record(ctx, []tag.Mutator{tag.Upsert(KeyProjectID, projectID), tag.Upsert(KeyOutcome, outcome)}, Rows.M(int64(n)))
+}
+
+// RecordConversionFailure records a row data of the project failed to be converted to time series.
+func RecordConversionFailure(ctx context.Context, projectID string) {
+	record(ctx, []tag.Mutator{tag.Upsert(KeyProjectID, projectID)}, ConversionFailures.M(1))
+}
+
+// RecordRPC records an RPC call to the project finished with code after latency.
+func RecordRPC(ctx context.Context, projectID string, code codes.Code, latency time.Duration) {
+	ms := float64(latency) / float64(time.Millisecond)
+	record(ctx, []tag.Mutator{tag.Upsert(KeyProjectID, projectID), tag.Upsert(KeyCode, codeName(code))}, RPCLatency.M(ms))
+}
+
+// RecordBundle records a bundle of the project with size row data being uploaded.
+func RecordBundle(ctx context.Context, projectID string, size int) {
+	record(ctx, []tag.Mutator{tag.Upsert(KeyProjectID, projectID)}, BundleSize.M(int64(size)))
+}
+
+// RecordBundlerOverflow records a row data of the project failed to be added to its bundle.
+func RecordBundlerOverflow(ctx context.Context, projectID string) {
+	record(ctx, []tag.Mutator{tag.Upsert(KeyProjectID, projectID)}, BundlerOverflows.M(1))
+}
+
+// RecordThrottle records a request of the project exceeding its rate limit, with the action taken
+// on it and the time it waited. delay of dropped requests is zero.
+func RecordThrottle(ctx context.Context, projectID, action string, delay time.Duration) {
+	ms := float64(delay) / float64(time.Millisecond)
+	record(ctx, []tag.Mutator{tag.Upsert(KeyProjectID, projectID), tag.Upsert(KeyThrottle, action)}, ThrottleDelay.M(ms))
+}
+
+func record(ctx context.Context, mutators []tag.Mutator, ms ...stats.Measurement) {
+	// Failing to record observability data must not affect the exporter, so we ignore errors.
+	stats.RecordWithTags(ctx, mutators, ms...)
+}
+
+// codeName returns name of the code in the same form used by gRPC status in stackdriver, like
+// "DEADLINE_EXCEEDED".
+func codeName(code codes.Code) string {
+	var b strings.Builder
+	var prevLower bool
+	for _, r := range code.String() {
+		isUpper := 'A' <= r && r <= 'Z'
+		if isUpper && prevLower {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+		prevLower = !isUpper
+	}
+	return strings.ToUpper(b.String())
+}
@@ -0,0 +1,26 @@
+package observability
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+// TestCodeName tests that names of codes are in the form used by stackdriver.
+func TestCodeName(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want string
+	}{
+		{codes.OK, "OK"},
+		{codes.Unavailable, "UNAVAILABLE"},
+		{codes.DeadlineExceeded, "DEADLINE_EXCEEDED"},
+		{codes.ResourceExhausted, "RESOURCE_EXHAUSTED"},
+		{codes.FailedPrecondition, "FAILED_PRECONDITION"},
+	}
+	for _, tt := range tests {
+		if got := codeName(tt.code); got != tt.want {
+			t.Errorf("codeName(%v) got: %s, want: %s", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opencensus.io/metric/metricdata"
+	ocresource "go.opencensus.io/resource"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	otelmetricdata "go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+)
+
+// OTelExporter is the exporter that can be registered to opentelemetry SDK via metric readers. It
+// converts opentelemetry metrics to opencensus metrics, and exports them through the StatsExporter
+// it wraps. Thus routing to projects, labeling and bundling are shared with opencensus data
+// exported by the StatsExporter. An OTelExporter object must be created by NewOTelExporter().
+//
+// Sums and gauges of int64 and float64, and histograms are supported. Non-monotonic sums are
+// exported as gauges, since stackdriver requires cumulative metrics to be monotonic.
+//
+// Label keys of an instrument are fixed when the instrument is exported with data points for the
+// first time, so that its view and metric descriptor don't change between exports. Data points
+// with attribute keys not in them are not exported, since dropping the attributes would merge
+// distinct time series, and they are reported by the error Export() returns on every export.
+//
+// Resource attributes are mapped to the monitored resource of GKE containers, GCE instances and
+// Cloud Run revisions by cloud.platform attribute. Other resources are left to MakeResource or
+// MakeMetricResource of the StatsExporter, and the latter gets resource attributes as labels of
+// the resource of the metric.
+type OTelExporter struct {
+	exp *StatsExporter
+
+	// mu protects fields below.
+	mu sync.Mutex
+	// labelKeys has label keys of instruments exported so far.
+	labelKeys map[otelInstrument][]metricdata.LabelKey
+	shutdown  bool
+}
+
+// otelInstrument identifies an instrument.
+type otelInstrument struct {
+	scope, name string
+}
+
+var _ sdkmetric.Exporter = (*OTelExporter)(nil)
+
+// errOTelShutdown is returned from Export() after Shutdown().
+var errOTelShutdown = errors.New("opentelemetry exporter is shut down")
+
+// NewOTelExporter creates an OTelExporter object exporting metrics through exp. exp is still owned
+// by the caller, who should shut it down after shutting down the OTelExporter.
+func NewOTelExporter(exp *StatsExporter) *OTelExporter {
+	return &OTelExporter{
+		exp:       exp,
+		labelKeys: map[otelInstrument][]metricdata.LabelKey{},
+	}
+}
+
+// Temporality returns cumulative temporality for all instruments, since stackdriver metrics of
+// opencensus are cumulative.
+func (o *OTelExporter) Temporality(sdkmetric.InstrumentKind) otelmetricdata.Temporality {
+	return otelmetricdata.CumulativeTemporality
+}
+
+// Aggregation returns default aggregation of the SDK for all instruments.
+func (o *OTelExporter) Aggregation(kind sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(kind)
+}
+
+// Export exports metrics in rm. Errors on exporting converted metrics are reported via OnError as
+// usual, but metrics and data points that can't be converted are reported by returned error, since
+// no RowData is made from them.
+func (o *OTelExporter) Export(ctx context.Context, rm *otelmetricdata.ResourceMetrics) error {
+	o.mu.Lock()
+	shutdown := o.shutdown
+	o.mu.Unlock()
+	if shutdown {
+		return errOTelShutdown
+	}
+
+	res := newOTelResource(rm.Resource)
+	var metrics []*metricdata.Metric
+	var errStrs []string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			keys, unknown := o.instrumentLabelKeys(otelInstrument{scope: sm.Scope.Name, name: m.Name}, otelAttributes(m.Data))
+			if len(unknown) != 0 {
+				keyNames := make([]string, len(keys))
+				for i, key := range keys {
+					keyNames[i] = key.Key
+				}
+				errStrs = append(errStrs, fmt.Sprintf("metric %s: data points with attributes %s are not exported, since label keys are fixed to [%s] at the first export", m.Name, strings.Join(unknown, ", "), strings.Join(keyNames, ", ")))
+			}
+			metric, err := newOTelMetric(m, keys)
+			if err != nil {
+				errStrs = append(errStrs, fmt.Sprintf("metric %s: %v", m.Name, err))
+				continue
+			}
+			metric.Resource = res
+			metrics = append(metrics, metric)
+		}
+	}
+	o.exp.ExportMetrics(ctx, metrics)
+	if len(errStrs) != 0 {
+		return fmt.Errorf("failed to convert opentelemetry metrics: %s", strings.Join(errStrs, "; "))
+	}
+	return nil
+}
+
+// ForceFlush flushes the underlying StatsExporter until ctx is done.
+func (o *OTelExporter) ForceFlush(ctx context.Context) error {
+	return o.exp.Flush(ctx)
+}
+
+// Shutdown flushes the underlying StatsExporter until ctx is done, and makes later Export() calls
+// fail. The StatsExporter is not shut down, since it's owned by the caller. Calls after the first
+// one do nothing.
+func (o *OTelExporter) Shutdown(ctx context.Context) error {
+	o.mu.Lock()
+	shutdown := o.shutdown
+	o.shutdown = true
+	o.mu.Unlock()
+	if shutdown {
+		return nil
+	}
+	return o.exp.Flush(ctx)
+}
+
+// instrumentLabelKeys returns label keys of the instrument, with sorted keys of attrs not in them.
+// On the first call for the instrument with data points, which have attrs, keys are fixed to the
+// sorted union of keys of attrs.
+func (o *OTelExporter) instrumentLabelKeys(inst otelInstrument, attrs []attribute.Set) (keys []metricdata.LabelKey, unknown []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	keys, ok := o.labelKeys[inst]
+	if !ok {
+		keys = newOTelLabelKeys(attrs)
+		if len(attrs) != 0 {
+			o.labelKeys[inst] = keys
+		}
+		return keys, nil
+	}
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		known[key.Key] = true
+	}
+	unknownSet := map[string]bool{}
+	for _, set := range attrs {
+		for _, kv := range set.ToSlice() {
+			if key := string(kv.Key); !known[key] && !unknownSet[key] {
+				unknownSet[key] = true
+				unknown = append(unknown, key)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return keys, unknown
+}
+
+// otelResourceTypes maps values of cloud.platform resource attribute to monitored resource types,
+// and each label of the type to the resource attributes it's read from, in the order of
+// preference.
+var otelResourceTypes = map[string]struct {
+	resType string
+	labels  map[string][]string
+}{
+	"gcp_kubernetes_engine": {"k8s_container", map[string][]string{
+		"project_id":     {"cloud.account.id"},
+		"location":       {"cloud.availability_zone", "cloud.region"},
+		"cluster_name":   {"k8s.cluster.name"},
+		"namespace_name": {"k8s.namespace.name"},
+		"pod_name":       {"k8s.pod.name"},
+		"container_name": {"k8s.container.name"},
+	}},
+	"gcp_compute_engine": {"gce_instance", map[string][]string{
+		"project_id":  {"cloud.account.id"},
+		"zone":        {"cloud.availability_zone"},
+		"instance_id": {"host.id"},
+	}},
+	"gcp_cloud_run": {"cloud_run_revision", map[string][]string{
+		"project_id":         {"cloud.account.id"},
+		"location":           {"cloud.region"},
+		"service_name":       {"faas.name", "service.name"},
+		"revision_name":      {"faas.version", "service.version"},
+		"configuration_name": {"faas.name", "service.name"},
+	}},
+}
+
+// newOTelResource converts opentelemetry resource to opencensus resource. When the platform of res
+// is known and all labels of its monitored resource are found, the returned resource has the type
+// and the labels of the monitored resource. Otherwise the returned resource has no type, and all
+// attributes of res as labels.
+func newOTelResource(res *sdkresource.Resource) *ocresource.Resource {
+	if res == nil || res.Len() == 0 {
+		return nil
+	}
+	attrs := make(map[string]string, res.Len())
+	for iter := res.Iter(); iter.Next(); {
+		kv := iter.Attribute()
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	resType, ok := otelResourceTypes[attrs["cloud.platform"]]
+	if !ok {
+		return &ocresource.Resource{Labels: attrs}
+	}
+	labels := make(map[string]string, len(resType.labels))
+	for label, keys := range resType.labels {
+		for _, key := range keys {
+			if value := attrs[key]; value != "" {
+				labels[label] = value
+				break
+			}
+		}
+		if labels[label] == "" {
+			return &ocresource.Resource{Labels: attrs}
+		}
+	}
+	return &ocresource.Resource{Type: resType.resType, Labels: labels}
+}
+
+// otelAttributes returns attributes of all data points in data.
+func otelAttributes(data otelmetricdata.Aggregation) []attribute.Set {
+	switch data := data.(type) {
+	case otelmetricdata.Gauge[int64]:
+		return pointAttributes(data.DataPoints)
+	case otelmetricdata.Gauge[float64]:
+		return pointAttributes(data.DataPoints)
+	case otelmetricdata.Sum[int64]:
+		return pointAttributes(data.DataPoints)
+	case otelmetricdata.Sum[float64]:
+		return pointAttributes(data.DataPoints)
+	case otelmetricdata.Histogram[int64]:
+		return histogramAttributes(data.DataPoints)
+	case otelmetricdata.Histogram[float64]:
+		return histogramAttributes(data.DataPoints)
+	default:
+		return nil
+	}
+}
+
+// pointAttributes returns attributes of data points of sums or gauges.
+func pointAttributes[N int64 | float64](dataPoints []otelmetricdata.DataPoint[N]) []attribute.Set {
+	attrs := make([]attribute.Set, len(dataPoints))
+	for i, dp := range dataPoints {
+		attrs[i] = dp.Attributes
+	}
+	return attrs
+}
+
+// histogramAttributes returns attributes of data points of histograms.
+func histogramAttributes[N int64 | float64](dataPoints []otelmetricdata.HistogramDataPoint[N]) []attribute.Set {
+	attrs := make([]attribute.Set, len(dataPoints))
+	for i, dp := range dataPoints {
+		attrs[i] = dp.Attributes
+	}
+	return attrs
+}
+
+// newOTelMetric converts opentelemetry metric to opencensus metric with label keys.
+func newOTelMetric(m otelmetricdata.Metrics, keys []metricdata.LabelKey) (*metricdata.Metric, error) {
+	desc := metricdata.Descriptor{
+		Name:        m.Name,
+		Description: m.Description,
+		Unit:        metricdata.Unit(m.Unit),
+		LabelKeys:   keys,
+	}
+	switch data := m.Data.(type) {
+	case otelmetricdata.Gauge[int64]:
+		desc.Type = metricdata.TypeGaugeInt64
+		return newOTelScalarMetric(desc, data.DataPoints), nil
+	case otelmetricdata.Gauge[float64]:
+		desc.Type = metricdata.TypeGaugeFloat64
+		return newOTelScalarMetric(desc, data.DataPoints), nil
+	case otelmetricdata.Sum[int64]:
+		desc.Type = metricdata.TypeGaugeInt64
+		if data.IsMonotonic {
+			desc.Type = metricdata.TypeCumulativeInt64
+		}
+		return newOTelScalarMetric(desc, data.DataPoints), nil
+	case otelmetricdata.Sum[float64]:
+		desc.Type = metricdata.TypeGaugeFloat64
+		if data.IsMonotonic {
+			desc.Type = metricdata.TypeCumulativeFloat64
+		}
+		return newOTelScalarMetric(desc, data.DataPoints), nil
+	case otelmetricdata.Histogram[int64]:
+		desc.Type = metricdata.TypeCumulativeDistribution
+		return newOTelHistogramMetric(desc, data.DataPoints), nil
+	case otelmetricdata.Histogram[float64]:
+		desc.Type = metricdata.TypeCumulativeDistribution
+		return newOTelHistogramMetric(desc, data.DataPoints), nil
+	default:
+		return nil, fmt.Errorf("unsupported aggregation %T", m.Data)
+	}
+}
+
+// newOTelScalarMetric converts opentelemetry data points of sums or gauges to opencensus metric with
+// desc.
+func newOTelScalarMetric[N int64 | float64](desc metricdata.Descriptor, dataPoints []otelmetricdata.DataPoint[N]) *metricdata.Metric {
+	metric := &metricdata.Metric{Descriptor: desc}
+	for _, dp := range dataPoints {
+		values, ok := newOTelLabelValues(desc.LabelKeys, dp.Attributes)
+		if !ok {
+			continue
+		}
+		var pt metricdata.Point
+		switch value := any(dp.Value).(type) {
+		case int64:
+			pt = metricdata.NewInt64Point(dp.Time, value)
+		case float64:
+			pt = metricdata.NewFloat64Point(dp.Time, value)
+		}
+		metric.TimeSeries = append(metric.TimeSeries, &metricdata.TimeSeries{
+			LabelValues: values,
+			Points:      []metricdata.Point{pt},
+			StartTime:   dp.StartTime,
+		})
+	}
+	return metric
+}
+
+// newOTelHistogramMetric converts opentelemetry data points of histograms to opencensus metric with
+// desc.
+func newOTelHistogramMetric[N int64 | float64](desc metricdata.Descriptor, dataPoints []otelmetricdata.HistogramDataPoint[N]) *metricdata.Metric {
+	metric := &metricdata.Metric{Descriptor: desc}
+	for _, dp := range dataPoints {
+		values, ok := newOTelLabelValues(desc.LabelKeys, dp.Attributes)
+		if !ok {
+			continue
+		}
+		dist := &metricdata.Distribution{
+			Count:         int64(dp.Count),
+			Sum:           float64(dp.Sum),
+			BucketOptions: &metricdata.BucketOptions{Bounds: dp.Bounds},
+			Buckets:       make([]metricdata.Bucket, len(dp.BucketCounts)),
+		}
+		for i, count := range dp.BucketCounts {
+			dist.Buckets[i].Count = int64(count)
+		}
+		metric.TimeSeries = append(metric.TimeSeries, &metricdata.TimeSeries{
+			LabelValues: values,
+			Points:      []metricdata.Point{metricdata.NewDistributionPoint(dp.Time, dist)},
+			StartTime:   dp.StartTime,
+		})
+	}
+	return metric
+}
+
+// newOTelLabelKeys returns sorted union of keys of all attrs.
+func newOTelLabelKeys(attrs []attribute.Set) []metricdata.LabelKey {
+	keySet := map[string]bool{}
+	for _, set := range attrs {
+		for _, kv := range set.ToSlice() {
+			keySet[string(kv.Key)] = true
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labelKeys := make([]metricdata.LabelKey, len(keys))
+	for i, key := range keys {
+		labelKeys[i] = metricdata.LabelKey{Key: key}
+	}
+	return labelKeys
+}
+
+// newOTelLabelValues returns label values of keys in attrs. ok is false when attrs has other keys,
+// which the label values can't hold.
+func newOTelLabelValues(keys []metricdata.LabelKey, attrs attribute.Set) (values []metricdata.LabelValue, ok bool) {
+	values = make([]metricdata.LabelValue, len(keys))
+	found := 0
+	for i, key := range keys {
+		if value, ok := attrs.Value(attribute.Key(key.Key)); ok {
+			values[i] = metricdata.NewLabelValue(value.Emit())
+			found++
+		}
+	}
+	return values, found == attrs.Len()
+}
@@ -0,0 +1,134 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/api/support/bundler"
+)
+
+// OverflowPolicy designates what to do with row data when the bundle of its project is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the row data being exported.
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropNextBundle drops the next bundle of the project handed over for upload while
+	// the row data being exported waits for room, and the row data takes the room made by that.
+	// Bundles are handed over in the order they are made, so the dropped one is the oldest bundle
+	// waiting for upload. Bundles that row data waiting for room have joined are never dropped,
+	// and nothing is dropped when room is made by uploads finished meanwhile.
+	OverflowDropNextBundle
+	// OverflowBlock makes the row data being exported wait for the room in the bundle.
+	OverflowBlock
+)
+
+// defaultOverflowTimeout is the default of OverflowTimeout, so that exporting row data never
+// blocks without limit when uploads stall.
+const defaultOverflowTimeout = 5 * time.Second
+
+// rowDataSize estimates memory held by rd in the bundler, in bytes. Views are shared by row data,
+// so they are not counted.
+func rowDataSize(rd *RowData) int {
+	// RowData, view.Row and the tag slice.
+	size := 96
+	for _, tag := range rd.Row.Tags {
+		size += 32 + len(tag.Key.Name()) + len(tag.Value)
+	}
+	switch data := rd.Row.Data.(type) {
+	case *view.DistributionData:
+		size += 64 + 8*len(data.CountPerBucket)
+		for _, exemplar := range data.ExemplarsPerBucket {
+			if exemplar != nil {
+				size += 64 + 32*len(exemplar.Attachments)
+			}
+		}
+	default:
+		size += 16
+	}
+	return size
+}
+
+// addRowData adds rd to the bundler of the project, dealing with overflow of the bundler as
+// designated by OverflowPolicy. Row data too large for the bundler are uploaded separately. It
+// returns errProjectDataStopped when the project data is stopped, and rd must be added to new
+// project data of the project.
+func (pd *projectData) addRowData(rd *RowData) error {
+	pd.stopMu.RLock()
+	defer pd.stopMu.RUnlock()
+	if pd.stopped {
+		return errProjectDataStopped
+	}
+	size := rowDataSize(rd)
+	err := pd.bndler.Add(rd, size)
+	if err == bundler.ErrOversizedItem {
+		pd.uploadOversized(rd)
+		return nil
+	}
+	if err != bundler.ErrOverflow {
+		return err
+	}
+
+	opts := pd.parent.opts
+	switch opts.OverflowPolicy {
+	case OverflowDropNextBundle:
+		pd.dropMu.Lock()
+		pd.dropRequests[rd] = true
+		pd.dropMu.Unlock()
+		// Once rd stops waiting, no bundle needs to be dropped for it.
+		defer func() {
+			pd.dropMu.Lock()
+			delete(pd.dropRequests, rd)
+			pd.dropMu.Unlock()
+		}()
+	case OverflowBlock:
+	default:
+		return err
+	}
+	timeout := opts.OverflowTimeout
+	if timeout <= 0 {
+		timeout = defaultOverflowTimeout
+	}
+	ctx, cancel := context.WithTimeout(pd.parent.ctx, timeout)
+	defer cancel()
+	return pd.bndler.AddWait(ctx, rd, size)
+}
+
+// takeDropRequest tells whether the bundle of rds should be dropped by OverflowDropNextBundle
+// policy, and if so, removes the request that the bundle is dropped for. A bundle that row data
+// waiting for room have joined is not dropped, and their requests are removed since they have
+// found room.
+func (pd *projectData) takeDropRequest(rds []*RowData) bool {
+	pd.dropMu.Lock()
+	defer pd.dropMu.Unlock()
+	if len(pd.dropRequests) == 0 {
+		return false
+	}
+	joined := false
+	for _, rd := range rds {
+		if pd.dropRequests[rd] {
+			delete(pd.dropRequests, rd)
+			joined = true
+		}
+	}
+	if joined {
+		return false
+	}
+	for rd := range pd.dropRequests {
+		delete(pd.dropRequests, rd)
+		return true
+	}
+	return false
+}
+
+// dropBundle drops rds of a bundle to make room for newer row data, and reports them.
+func (pd *projectData) dropBundle(rds []*RowData) {
+	exp := pd.parent
+	newErr := fmt.Errorf("bundle for project %s is dropped to make room for newer row data", pd.projectID)
+	exp.onError(newErr, rds...)
+	exp.forgetMetricSources(rds...)
+	observability.RecordRows(exp.ctx, pd.projectID, observability.OutcomeDropped, len(rds))
+}
@@ -0,0 +1,193 @@
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+// When stackdriver rejects some of time series in a create time series request, the returned status
+// may have details telling which time series failed:
+//   - BadRequest, whose field violations have fields like "timeSeries[3].points[0]" and
+//     descriptions of causes.
+//   - CreateTimeSeriesSummary, which only has numbers of failed points for each cause.
+//
+// We map field violations back to RowData, and check them against the summary. When there are no
+// usable details, we fall back to parsing the error message, which lists causes of failures with
+// indices of time series in the request, like
+//
+//	One or more TimeSeries could not be written: <cause 1>: timeSeries[0-2,5]; <cause 2>: timeSeries[3]
+const (
+	seriesFieldPrefix = "timeSeries["
+
+	partialErrorPrefix = "could not be written: "
+	partialErrorSep    = "; "
+	indicesPrefix      = ": timeSeries["
+	indicesSuffix      = "]"
+)
+
+// partialFailure is a group of time series in a request that failed by the same cause.
+type partialFailure struct {
+	cause   string
+	indices []int
+}
+
+// parsePartialFailures parses err returned from create time series RPC call whose request has
+// tsLen time series, and returns failed time series grouped by causes. ok is false when err does
+// not tell exactly which time series failed.
+func parsePartialFailures(err error, tsLen int) (failures []partialFailure, ok bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, false
+	}
+	var violations []*errdetails.BadRequest_FieldViolation
+	// failedPoints is the number of failed points in the summary, or -1 without summary.
+	failedPoints := -1
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.BadRequest:
+			violations = append(violations, d.FieldViolations...)
+		case *monitoringpb.CreateTimeSeriesSummary:
+			failedPoints = int(d.TotalPointCount - d.SuccessPointCount)
+		}
+	}
+
+	if len(violations) != 0 {
+		failures, ok = violationFailures(violations, tsLen)
+	} else {
+		failures, ok = messageFailures(st.Message(), tsLen)
+	}
+	if !ok {
+		return nil, false
+	}
+	// Each time series has a single point, so the summary must agree with failures we found.
+	if 0 <= failedPoints && failedPoints != countIndices(failures) {
+		return nil, false
+	}
+	return failures, true
+}
+
+// violationFailures groups field violations of time series by their descriptions. All violations
+// must be on time series.
+func violationFailures(violations []*errdetails.BadRequest_FieldViolation, tsLen int) ([]partialFailure, bool) {
+	var failures []partialFailure
+	// causeIdx maps causes to their positions in failures, and seen records time series already
+	// in failures of each cause.
+	causeIdx := map[string]int{}
+	seen := map[string]map[int]bool{}
+	for _, violation := range violations {
+		field := violation.Field
+		if !strings.HasPrefix(field, seriesFieldPrefix) {
+			return nil, false
+		}
+		end := strings.Index(field, "]")
+		if end < 0 {
+			return nil, false
+		}
+		idx, err := strconv.Atoi(field[len(seriesFieldPrefix):end])
+		if err != nil || idx < 0 || tsLen <= idx {
+			return nil, false
+		}
+		cause := violation.Description
+		pos, ok := causeIdx[cause]
+		if !ok {
+			pos = len(failures)
+			causeIdx[cause] = pos
+			seen[cause] = map[int]bool{}
+			failures = append(failures, partialFailure{cause: cause})
+		}
+		if seen[cause][idx] {
+			// A time series may have several violations of the same cause.
+			continue
+		}
+		seen[cause][idx] = true
+		failures[pos].indices = append(failures[pos].indices, idx)
+	}
+	return failures, len(failures) != 0
+}
+
+// messageFailures parses the error message of the status, which is the fallback for errors without
+// field violations.
+func messageFailures(msg string, tsLen int) ([]partialFailure, bool) {
+	pos := strings.Index(msg, partialErrorPrefix)
+	if pos < 0 {
+		return nil, false
+	}
+	var failures []partialFailure
+	for _, part := range strings.Split(msg[pos+len(partialErrorPrefix):], partialErrorSep) {
+		pos := strings.LastIndex(part, indicesPrefix)
+		if pos < 0 || !strings.HasSuffix(part, indicesSuffix) {
+			return nil, false
+		}
+		indices, err := parseIndices(part[pos+len(indicesPrefix):len(part)-len(indicesSuffix)], tsLen)
+		if err != nil {
+			return nil, false
+		}
+		failures = append(failures, partialFailure{cause: part[:pos], indices: indices})
+	}
+	return failures, len(failures) != 0
+}
+
+// countIndices counts distinct time series in failures.
+func countIndices(failures []partialFailure) int {
+	set := map[int]bool{}
+	for _, failure := range failures {
+		for _, idx := range failure.indices {
+			set[idx] = true
+		}
+	}
+	return len(set)
+}
+
+// parseIndices parses comma separated list of indices or index ranges like "0-2,5". All indices must
+// be smaller than tsLen.
+func parseIndices(list string, tsLen int) ([]int, error) {
+	var indices []int
+	for _, item := range strings.Split(list, ",") {
+		first, last := item, item
+		if pos := strings.Index(item, "-"); 0 <= pos {
+			first, last = item[:pos], item[pos+1:]
+		}
+		begin, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil {
+			return nil, err
+		}
+		if begin < 0 || end < begin || tsLen <= end {
+			return nil, fmt.Errorf("invalid index range: %s", item)
+		}
+		for idx := begin; idx <= end; idx++ {
+			indices = append(indices, idx)
+		}
+	}
+	return indices, nil
+}
+
+// reportUploadError reports err, which is returned from create time series RPC call whose request
+// is made from reqRds. When err tells which time series failed, only the row data of failed time
+// series are reported, grouped by causes of the failures.
+func (pd *projectData) reportUploadError(err error, reqRds []*RowData) {
+	exp := pd.parent
+	failures, ok := parsePartialFailures(err, len(reqRds))
+	if !ok {
+		newErr := fmt.Errorf("RPC call to create time series failed for project %s: %v", pd.projectID, err)
+		// We pass all row data not successfully uploaded.
+		exp.onError(newErr, reqRds...)
+		return
+	}
+	for _, failure := range failures {
+		rds := make([]*RowData, len(failure.indices))
+		for i, idx := range failure.indices {
+			rds[i] = reqRds[idx]
+		}
+		newErr := fmt.Errorf("RPC call to create time series failed for project %s: %s", pd.projectID, failure.cause)
+		exp.onError(newErr, rds...)
+	}
+}
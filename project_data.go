@@ -1,10 +1,14 @@
 package exporter
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	"go.opencensus.io/tag"
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"go.opencensus.io/stats/view"
 	"google.golang.org/api/support/bundler"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
@@ -20,11 +24,52 @@ type projectData struct {
 	// We make bundler for each project because call to monitoring RPC can be grouped only in
 	// project level
 	bndler expBundler
+	// lastUsed is the last time that row data is exported to the project. It is protected by mu
+	// of the parent exporter.
+	lastUsed time.Time
+	// stopMu protects stopped, which is set when the project data is removed from the exporter.
+	// Row data are added to the bundler holding read lock of stopMu, so that no row data is
+	// added to the bundler once it's stopped.
+	stopMu  sync.RWMutex
+	stopped bool
+	// limiter limits uploads to the project. It is nil when uploads are not limited.
+	limiter *projectLimiter
+	// clientMu protects client, which is the metric client of the project, and clientKey, which
+	// is the key of client when it's cached by the exporter. They are resolved on first use by
+	// metricClient().
+	clientMu  sync.Mutex
+	client    metricClient
+	clientKey *clientKey
+	// tracker tracks cumulative time series of the project. It is nil unless TrackCumulative or
+	// MetricKinds option is set.
+	tracker *seriesTracker
+	// dropMu protects dropRequests, which has row data waiting for room made by dropping a
+	// bundle with OverflowDropNextBundle policy. A request is removed when a bundle is dropped for
+	// it, or when the row data stops waiting.
+	dropMu       sync.Mutex
+	dropRequests map[*RowData]bool
+	// replayMu serializes replays of spooled requests of the project, so that requests are
+	// replayed once and in order.
+	replayMu sync.Mutex
+
+	// mu protects descriptors and descCalls.
+	mu sync.Mutex
+	// descriptors caches metric descriptors known to exist in the project, keyed by metric type.
+	descriptors map[string]*metricpb.MetricDescriptor
+	// descCalls holds in-flight RPC calls for metric descriptors, keyed by metric type.
+	descCalls map[string]*descCall
+
+	// oversizedMu protects oversized.
+	oversizedMu sync.Mutex
+	// oversized holds channels of in-flight uploads of row data too large for the bundler, which
+	// are made outside of the bundler. Each channel is closed when its upload is done.
+	oversized map[chan struct{}]bool
 }
 
 // We wrap bundler and its maker for testing purpose.
 type expBundler interface {
 	Add(interface{}, int) error
+	AddWait(context.Context, interface{}, int) error
 	Flush()
 }
 
@@ -32,15 +77,24 @@ var newExpBundler = defaultNewExpBundler
 
 // Since options in bundler are directly set to its fields and interface does not allow any fields,
 // we put option set-up process inside bundler's maker.
-func defaultNewExpBundler(uploader func(interface{}), delayThreshold time.Duration, countThreshold int) expBundler {
+func defaultNewExpBundler(uploader func(interface{}), opts *Options) expBundler {
 	bndler := bundler.NewBundler((*RowData)(nil), uploader)
 
 	// Set options for bundler if they are provided by users.
-	if 0 < delayThreshold {
-		bndler.DelayThreshold = delayThreshold
+	if 0 < opts.BundleDelayThreshold {
+		bndler.DelayThreshold = opts.BundleDelayThreshold
+	}
+	if 0 < opts.BundleCountThreshold {
+		bndler.BundleCountThreshold = opts.BundleCountThreshold
 	}
-	if 0 < countThreshold {
-		bndler.BundleCountThreshold = countThreshold
+	if 0 < opts.BundleByteThreshold {
+		bndler.BundleByteThreshold = opts.BundleByteThreshold
+	}
+	if 0 < opts.BundleHandlerLimit {
+		bndler.HandlerLimit = opts.BundleHandlerLimit
+	}
+	if 0 < opts.BundleBufferedByteLimit {
+		bndler.BufferedByteLimit = opts.BundleBufferedByteLimit
 	}
 
 	return bndler
@@ -48,36 +102,173 @@ func defaultNewExpBundler(uploader func(interface{}), delayThreshold time.Durati
 
 func (e *StatsExporter) newProjectData(projectID string) *projectData {
 	pd := &projectData{
-		parent:    e,
-		projectID: projectID,
+		parent:       e,
+		projectID:    projectID,
+		descriptors:  make(map[string]*metricpb.MetricDescriptor),
+		descCalls:    make(map[string]*descCall),
+		oversized:    make(map[chan struct{}]bool),
+		dropRequests: make(map[*RowData]bool),
+		limiter:      e.newLimiter(projectID),
+	}
+	if e.opts.TrackCumulative || len(e.opts.MetricKinds) != 0 {
+		pd.tracker = newSeriesTracker(e.opts.MaxTrackedSeries)
 	}
 
-	pd.bndler = newExpBundler(pd.uploadRowData, e.opts.BundleDelayThreshold, e.opts.BundleCountThreshold)
+	pd.bndler = newExpBundler(pd.uploadBundle, e.opts)
 	return pd
 }
 
-// uploadRowData is called by bundler to upload row data, and report any error happened meanwhile.
+// uploadOversized uploads row data too large for the bundler in a separate goroutine. The upload
+// is waited by flush.
+func (pd *projectData) uploadOversized(rd *RowData) {
+	done := make(chan struct{})
+	pd.oversizedMu.Lock()
+	pd.oversized[done] = true
+	pd.oversizedMu.Unlock()
+
+	go func() {
+		pd.uploadRowData([]*RowData{rd})
+		pd.oversizedMu.Lock()
+		delete(pd.oversized, done)
+		pd.oversizedMu.Unlock()
+		close(done)
+	}()
+}
+
+// errProjectDataStopped is returned by addRowData() when the project data is stopped.
+var errProjectDataStopped = errors.New("project data is stopped")
+
+// stop makes further row data not to be added to the project data, flushes it, and releases its
+// metric client. It's called when the project data is removed from the exporter, and the bundler
+// of the project data is not used any more.
+func (pd *projectData) stop() {
+	pd.stopMu.Lock()
+	pd.stopped = true
+	pd.stopMu.Unlock()
+	pd.flush()
+	pd.releaseClient()
+}
+
+// pendingOversized returns the number of in-flight uploads of oversized row data.
+func (pd *projectData) pendingOversized() int {
+	pd.oversizedMu.Lock()
+	defer pd.oversizedMu.Unlock()
+	return len(pd.oversized)
+}
+
+// flush uploads all row data in the bundler, and waits until the uploads and those of oversized
+// row data started so far are done.
+func (pd *projectData) flush() {
+	pd.bndler.Flush()
+
+	pd.oversizedMu.Lock()
+	dones := make([]chan struct{}, 0, len(pd.oversized))
+	for done := range pd.oversized {
+		dones = append(dones, done)
+	}
+	pd.oversizedMu.Unlock()
+	for _, done := range dones {
+		<-done
+	}
+}
+
+// uploadBundle is called by bundler to upload a bundle, unless it's dropped by overflow policy.
+// Row data uploaded outside of the bundler don't go through it, since they are not bundles made
+// room for.
+func (pd *projectData) uploadBundle(bundle interface{}) {
+	if rds := bundle.([]*RowData); pd.takeDropRequest(rds) {
+		pd.dropBundle(rds)
+		return
+	}
+	pd.uploadRowData(bundle)
+}
+
+// uploadRowData uploads row data, and report any error happened meanwhile.
 func (pd *projectData) uploadRowData(bundle interface{}) {
-	exp := pd.parent
 	rds := bundle.([]*RowData)
+	defer pd.parent.forgetMetricSources(rds...)
+	observability.RecordBundle(pd.parent.ctx, pd.projectID, len(rds))
+	if _, err := pd.metricClient(); err != nil {
+		pd.parent.onError(err, rds...)
+		return
+	}
 
 	// reqRds contains RowData objects those are uploaded to stackdriver at given iteration.
 	// It's main usage is for error reporting. For actual uploading operation, we use req.
-	// remainingRds are RowData that has not been processed at all.
+	// remainingRds are RowData that has not been processed at all. states are states of tracked
+	// series in req, which are committed only for points actually exported. Otherwise the next
+	// point of the series is converted against the state before req, so that it covers the
+	// interval of the point not exported.
 	var reqRds, remainingRds []*RowData
+	var states []*seriesState
 	for ; len(rds) != 0; rds = remainingRds {
 		var req *monitoringpb.CreateTimeSeriesRequest
-		req, reqRds, remainingRds = pd.makeReq(rds)
+		req, reqRds, states, remainingRds = pd.makeReq(rds)
 		if req == nil {
 			// no need to perform RPC call for empty set of requests.
 			continue
 		}
-		if err := exp.client.CreateTimeSeries(exp.ctx, req); err != nil {
-			newErr := fmt.Errorf("RPC call to create time series failed for project %s: %v", pd.projectID, err)
-			// We pass all row data not successfully uploaded.
-			exp.onError(newErr, reqRds...)
+		pd.sendReq(req, reqRds, states)
+		pd.releaseSeries(states)
+	}
+}
+
+// sendReq uploads req made by makeReq, and commits states of series exported by it.
+func (pd *projectData) sendReq(req *monitoringpb.CreateTimeSeriesRequest, reqRds []*RowData, states []*seriesState) {
+	if spool := pd.parent.spool; spool != nil && !spool.replay(pd) {
+		// Stackdriver rejects points older than the last point of their series, so req can't
+		// be uploaded before spooled requests of the project. We spool req after them.
+		pd.spoolRequest(req, reqRds, errReplayPending)
+		return
+	}
+	if !pd.takeRateLimit(len(req.TimeSeries)) {
+		pd.parent.onError(&RateLimitError{ProjectID: pd.projectID}, reqRds...)
+		return
+	}
+	err := pd.upload(req, reqRds)
+	switch {
+	case err == nil:
+		pd.commitStates(states, nil)
+	case pd.parent.opts.Sink != nil:
+		newErr := fmt.Errorf("sink failed to export time series for project %s: %v", pd.projectID, err)
+		pd.parent.onError(newErr, reqRds...)
+		pd.commitStates(states, err)
+	case pd.parent.spool != nil && retryable(err):
+		pd.spoolRequest(req, reqRds, err)
+	default:
+		pd.reportUploadError(err, reqRds)
+		pd.commitStates(states, err)
+	}
+}
+
+// errReplayPending is the reason of spooling a request when spooled requests of the project are
+// not replayed yet.
+var errReplayPending = errors.New("earlier requests of the project are not replayed from the spool yet")
+
+// spoolRequest persists req, which is not uploaded because of err, to be uploaded later. If
+// spooling fails, reqRds are reported with both errors. Points of DELTA metric kind are not spooled, since
+// states of their series are not committed, and the next points of the series cover their
+// intervals.
+func (pd *projectData) spoolRequest(req *monitoringpb.CreateTimeSeriesRequest, reqRds []*RowData, err error) {
+	var timeSeries []*monitoringpb.TimeSeries
+	var rds []*RowData
+	for i, rd := range reqRds {
+		if pd.parent.metricKind(rd.View) != metricpb.MetricDescriptor_DELTA {
+			timeSeries = append(timeSeries, req.TimeSeries[i])
+			rds = append(rds, rd)
 		}
 	}
+	if len(timeSeries) == 0 {
+		return
+	}
+	if len(timeSeries) != len(req.TimeSeries) {
+		req = &monitoringpb.CreateTimeSeriesRequest{Name: req.Name, TimeSeries: timeSeries}
+		reqRds = rds
+	}
+	if spoolErr := pd.parent.spool.write(pd.projectID, req); spoolErr != nil {
+		newErr := fmt.Errorf("failed to upload time series for project %s: %v, and spooling the request also failed: %v", pd.projectID, err, spoolErr)
+		pd.parent.onError(newErr, reqRds...)
+	}
 }
 
 // makeReq creates a request that's suitable to be passed to create time series RPC call.
@@ -86,49 +277,125 @@ func (pd *projectData) uploadRowData(bundle interface{}) {
 // creating time series failed. (We don't want users to investigate structure of timeseries.)
 // remainingRds contains rows those are not used at all in makeReq because of the length limitation
 // or request. Another call of makeReq() with remainigRds will handle (some) rows in them. When req
-// is nil, then there's nothing to request and reqRds will also contain nothing.
+// is nil, then there's nothing to request and reqRds will also contain nothing. states has states
+// of tracked series after req is exported, with nil for series not tracked, in the same order as
+// reqRds. A request has at most one point of a tracked series, since the next point must be
+// converted against the state committed after the request. Series of states are acquired from
+// the tracker until the caller releases them with releaseSeries(), so that concurrent uploads
+// convert points of a series one at a time.
 //
 // Some rows in rds may fail while converting them to time series, and in that case makeReq() calls
 // exporter's onError() directly, not propagating errors to the caller.
-func (pd *projectData) makeReq(rds []*RowData) (req *monitoringpb.CreateTimeSeriesRequest, reqRds, remainingRds []*RowData) {
+func (pd *projectData) makeReq(rds []*RowData) (req *monitoringpb.CreateTimeSeriesRequest, reqRds []*RowData, states []*seriesState, remainingRds []*RowData) {
 	exp := pd.parent
 	timeSeries := []*monitoringpb.TimeSeries{}
 
-	var i int
-	var rd *RowData
-	for i, rd = range rds {
+	// descResults caches results of getting metric descriptors, so that we don't repeat failing
+	// RPC calls for each row data of the same metric.
+	descResults := map[string]descResult{}
+	// trackedKeys has keys of tracked series in the request.
+	trackedKeys := map[string]bool{}
+
+	// next is the index of the first row data not processed.
+	next := len(rds)
+	for i, rd := range rds {
+		metricType, err := pd.metricType(rd)
+		if err != nil {
+			pd.parent.onError(err, rd)
+			continue
+		}
+		var desc *metricpb.MetricDescriptor
+		if exp.opts.Sink == nil && (exp.opts.CreateMetricDescriptors || exp.opts.ValidateRowData) {
+			res, ok := descResults[metricType]
+			if !ok {
+				res.desc, res.err = pd.metricDescriptor(rd.View, metricType)
+				descResults[metricType] = res
+			}
+			if res.err != nil {
+				pd.parent.onError(res.err, rd)
+				continue
+			}
+			desc = res.desc
+		}
 		pt := newPoint(rd.View, rd.Row, rd.Start, rd.End)
 		if pt.Value == nil {
 			err := fmt.Errorf("inconsistent data found in view %s", rd.View.Name)
 			pd.parent.onError(err, rd)
+			observability.RecordConversionFailure(exp.ctx, pd.projectID)
 			continue
 		}
-		resource, err := exp.makeResource(rd)
+		if src := exp.metricSourceOf(rd); src != nil {
+			src.fixValue(pt.Value)
+		}
+		if dist, ok := pt.Value.Value.(*monitoringpb.TypedValue_DistributionValue); ok {
+			pd.decorateDistribution(dist.DistributionValue, rd.Row.Data.(*view.DistributionData))
+		}
+		resource, err := exp.resourceOf(rd)
 		if err != nil {
 			newErr := fmt.Errorf("failed to construct resource of view %s: %v", rd.View.Name, err)
 			pd.parent.onError(newErr, rd)
+			observability.RecordConversionFailure(exp.ctx, pd.projectID)
 			continue
 		}
+		labels := exp.makeLabels(rd)
+		if exp.opts.ValidateRowData && exp.opts.Sink == nil {
+			if err := pd.validateRowData(rd, labels, desc); err != nil {
+				pd.parent.onError(err, rd)
+				continue
+			}
+		}
 
 		ts := &monitoringpb.TimeSeries{
 			Metric: &metricpb.Metric{
-				Type:   rd.View.Name,
-				Labels: exp.makeLabels(rd.Row.Tags),
+				Type:   metricType,
+				Labels: labels,
 			},
 			Resource: resource,
 			Points:   []*monitoringpb.Point{pt},
 		}
-		// Growing timeseries and reqRds are done at same time.
+		var state *seriesState
+		if pt.Interval.StartTime != nil {
+			var key string
+			if pd.tracksSeries(rd) {
+				key = timeSeriesKey(ts)
+				if trackedKeys[key] {
+					next = i
+					break
+				}
+				if !pd.tracker.tryAcquire(key) {
+					if len(trackedKeys) != 0 {
+						// Waiting for the series while holding others may deadlock with the
+						// upload converting it, so req is sent first.
+						next = i
+						break
+					}
+					pd.tracker.acquire(key)
+				}
+			}
+			var ok bool
+			state, ok = pd.convertPoint(rd, ts, key)
+			if state == nil && key != "" {
+				pd.tracker.release(key)
+			}
+			if !ok {
+				continue
+			}
+			if state != nil {
+				trackedKeys[key] = true
+			}
+		}
+		// Growing timeseries, reqRds and states are done at same time.
 		timeSeries = append(timeSeries, ts)
 		reqRds = append(reqRds, rd)
+		states = append(states, state)
 		// Don't grow timeseries over the limit.
 		if len(timeSeries) == MaxTimeSeriesPerUpload {
+			next = i + 1
 			break
 		}
 	}
 
-	// Since i is the last index processed, remainingRds should start from i+1.
-	remainingRds = rds[i+1:]
+	remainingRds = rds[next:]
 	if len(timeSeries) == 0 {
 		req = nil
 	} else {
@@ -137,12 +404,13 @@ func (pd *projectData) makeReq(rds []*RowData) (req *monitoringpb.CreateTimeSeri
 			TimeSeries: timeSeries,
 		}
 	}
-	return req, reqRds, remainingRds
+	return req, reqRds, states, remainingRds
 }
 
 // makeLables constructs label that's ready for being uploaded to stackdriver.
-func (e *StatsExporter) makeLabels(tags []tag.Tag) map[string]string {
+func (e *StatsExporter) makeLabels(rd *RowData) map[string]string {
 	opts := e.opts
+	tags := rd.Row.Tags
 	labels := make(map[string]string, len(opts.DefaultLabels)+len(tags))
 	for key, val := range opts.DefaultLabels {
 		labels[key] = val
@@ -155,5 +423,8 @@ func (e *StatsExporter) makeLabels(tags []tag.Tag) map[string]string {
 	for _, key := range opts.UnexportedLabels {
 		delete(labels, key)
 	}
+	if opts.SanitizeLabels {
+		labels = e.sanitizeLabels(rd, labels)
+	}
 	return labels
 }
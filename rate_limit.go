@@ -0,0 +1,167 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lychung83/stackdriver-exporter/observability"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitPolicy designates what to do with requests exceeding rate limits.
+type RateLimitPolicy int
+
+const (
+	// RateLimitWait makes requests wait until they are within rate limits. Row data keep being
+	// bundled meanwhile, and they are dropped when the bundler overflows. Waiting requests are
+	// also dropped when the context of the exporter is done.
+	RateLimitWait RateLimitPolicy = iota
+	// RateLimitDrop drops requests exceeding rate limits, and reports them via OnError with
+	// RateLimitError.
+	RateLimitDrop
+)
+
+// RateLimit limits uploads to a project with token buckets. RequestsPerSecond limits RPC calls to
+// create time series, and SeriesPerSecond limits time series in those calls. Bursts are sizes of
+// buckets. Zero rate means no limit. Zero bursts mean default values, 1 for RequestBurst and
+// maximum number of time series in a request for SeriesBurst.
+type RateLimit struct {
+	RequestsPerSecond float64
+	RequestBurst      int
+	SeriesPerSecond   float64
+	SeriesBurst       int
+	Policy            RateLimitPolicy
+}
+
+// RateLimitError is reported via OnError when a request is dropped by RateLimitDrop policy. See
+// RateLimit of Options.
+type RateLimitError struct {
+	ProjectID string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("request to create time series for project %s is dropped by rate limit", e.ProjectID)
+}
+
+// projectLimiter limits uploads to a project. It should be created by newProjectLimiter().
+type projectLimiter struct {
+	// requests and series are nil when they are not limited.
+	requests *rate.Limiter
+	series   *rate.Limiter
+	policy   RateLimitPolicy
+}
+
+// newProjectLimiter creates projectLimiter from rl. It returns nil when rl doesn't limit anything.
+func newProjectLimiter(rl *RateLimit) *projectLimiter {
+	if rl == nil || (rl.RequestsPerSecond <= 0 && rl.SeriesPerSecond <= 0) {
+		return nil
+	}
+	l := &projectLimiter{policy: rl.Policy}
+	if 0 < rl.RequestsPerSecond {
+		burst := rl.RequestBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		l.requests = rate.NewLimiter(rate.Limit(rl.RequestsPerSecond), burst)
+	}
+	if 0 < rl.SeriesPerSecond {
+		burst := rl.SeriesBurst
+		if burst <= 0 {
+			burst = MaxTimeSeriesPerUpload
+		}
+		l.series = rate.NewLimiter(rate.Limit(rl.SeriesPerSecond), burst)
+	}
+	return l
+}
+
+// take takes tokens for a request with n time series. With RateLimitWait policy, it waits until
+// tokens are available, and returns the time waited. It returns false when the request must be
+// dropped, that is, tokens are not available right now with RateLimitDrop policy, or ctx is done
+// while waiting.
+func (l *projectLimiter) take(ctx context.Context, n int) (time.Duration, bool) {
+	if l.policy == RateLimitDrop {
+		return 0, l.allow(n)
+	}
+	start := time.Now()
+	waited := false
+	wait := func(lim *rate.Limiter, k int) error {
+		if lim == nil {
+			return nil
+		}
+		if lim.Tokens() < float64(k) {
+			waited = true
+		}
+		return lim.WaitN(ctx, k)
+	}
+	if err := wait(l.requests, 1); err != nil {
+		return 0, false
+	}
+	if err := wait(l.series, tokensOf(l.series, n)); err != nil {
+		return 0, false
+	}
+	if !waited {
+		return 0, true
+	}
+	return time.Since(start), true
+}
+
+// allow takes tokens for a request with n time series only when all of them are available right
+// now.
+func (l *projectLimiter) allow(n int) bool {
+	now := time.Now()
+	var reservations []*rate.Reservation
+	ok := true
+	reserve := func(lim *rate.Limiter, k int) {
+		if lim == nil {
+			return
+		}
+		r := lim.ReserveN(now, k)
+		reservations = append(reservations, r)
+		if 0 < r.DelayFrom(now) {
+			ok = false
+		}
+	}
+	reserve(l.requests, 1)
+	reserve(l.series, tokensOf(l.series, n))
+	if !ok {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	return ok
+}
+
+// tokensOf returns the number of tokens of lim taken for n time series. Requests larger than the
+// bucket would never be allowed, so we let them empty the bucket instead.
+func tokensOf(lim *rate.Limiter, n int) int {
+	if lim != nil && lim.Burst() < n {
+		return lim.Burst()
+	}
+	return n
+}
+
+// newLimiter creates the limiter of the project from rate limit options.
+func (e *StatsExporter) newLimiter(projectID string) *projectLimiter {
+	if rl, ok := e.opts.ProjectRateLimits[projectID]; ok {
+		return newProjectLimiter(rl)
+	}
+	return newProjectLimiter(e.opts.RateLimit)
+}
+
+// takeRateLimit tells whether a request with n time series can be uploaded under the rate limit
+// of the project, waiting for it if necessary.
+func (pd *projectData) takeRateLimit(n int) bool {
+	if pd.limiter == nil {
+		return true
+	}
+	ctx := pd.parent.ctx
+	delay, ok := pd.limiter.take(ctx, n)
+	switch {
+	case !ok:
+		observability.RecordThrottle(ctx, pd.projectID, observability.ThrottleDropped, 0)
+	case 0 < delay:
+		observability.RecordThrottle(ctx, pd.projectID, observability.ThrottleDelayed, delay)
+	}
+	return ok
+}
@@ -0,0 +1,261 @@
+// Package resource detects the environment the program is running on, and builds stackdriver
+// monitored resource for it. Detector.MakeResource() can be used directly as MakeResource of
+// exporter options.
+package resource
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	exporter "github.com/lychung83/stackdriver-exporter"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// default values of Detector fields.
+const (
+	defaultMetadataEndpoint = "http://metadata.google.internal"
+	defaultTimeout          = 2 * time.Second
+	namespaceFile           = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// Detector detects GCP environment and builds monitored resource for it. Supported resources are
+// cloud_run_revision, k8s_container and gce_instance in the order of precedence. When none of them
+// is detected, generic_task is used. Default value of fields in Detector are valid for use.
+type Detector struct {
+	// MetadataEndpoint is the base URL of the metadata server. Tests may set it to a local
+	// HTTP server. Default value is "http://metadata.google.internal".
+	MetadataEndpoint string
+	// HTTPClient is used for requests to the metadata server. Default client times out in 2
+	// seconds.
+	HTTPClient *http.Client
+	// Getenv and ReadFile are used to read environment variables and files. Default values are
+	// os.Getenv and ioutil.ReadFile.
+	Getenv   func(key string) string
+	ReadFile func(filename string) ([]byte, error)
+
+	// labels of generic_task resource. When not set, project_id is read from
+	// GOOGLE_CLOUD_PROJECT environment variable, location is "global", namespace is empty, job
+	// is the name of the program and task_id is made from the host name and the process ID.
+	ProjectID, Location, Namespace, Job, TaskID string
+
+	// mu protects resource, which caches the resource detected for MakeResource.
+	mu       sync.Mutex
+	resource *monitoredrespb.MonitoredResource
+}
+
+// MakeResource returns a function that can be used as MakeResource of exporter options. The
+// environment is detected on the first call, and the detected resource is used for all row data,
+// except that labels of the resource are overridden by tags of row data with the same keys.
+// Failures of detection, like transient errors of the metadata server, are not cached, so the
+// detection is retried on later calls until it succeeds.
+func (d *Detector) MakeResource() func(*exporter.RowData) (*monitoredrespb.MonitoredResource, error) {
+	return func(rd *exporter.RowData) (*monitoredrespb.MonitoredResource, error) {
+		resource, err := d.detected()
+		if err != nil {
+			return nil, err
+		}
+
+		labels := make(map[string]string, len(resource.Labels))
+		for key, value := range resource.Labels {
+			labels[key] = value
+		}
+		for _, tag := range rd.Row.Tags {
+			if _, ok := labels[tag.Key.Name()]; ok {
+				labels[tag.Key.Name()] = tag.Value
+			}
+		}
+		return &monitoredrespb.MonitoredResource{
+			Type:   resource.Type,
+			Labels: labels,
+		}, nil
+	}
+}
+
+// detected returns the resource detected for MakeResource, detecting it unless it's already
+// detected.
+func (d *Detector) detected() (*monitoredrespb.MonitoredResource, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.resource == nil {
+		resource, err := d.Detect(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		d.resource = resource
+	}
+	return d.resource, nil
+}
+
+// Detect detects the environment and returns monitored resource for it.
+func (d *Detector) Detect(ctx context.Context) (*monitoredrespb.MonitoredResource, error) {
+	getenv := d.getenv()
+	projectID, err := d.metadata(ctx, "project/project-id")
+	if err != nil {
+		// We are not on GCP, or metadata server is not available.
+		return d.genericTask(), nil
+	}
+
+	switch {
+	case getenv("K_SERVICE") != "" && getenv("K_CONFIGURATION") != "":
+		return d.cloudRunRevision(ctx, projectID)
+	case getenv("KUBERNETES_SERVICE_HOST") != "":
+		return d.k8sContainer(ctx, projectID)
+	default:
+		return d.gceInstance(ctx, projectID)
+	}
+}
+
+func (d *Detector) cloudRunRevision(ctx context.Context, projectID string) (*monitoredrespb.MonitoredResource, error) {
+	getenv := d.getenv()
+	// region is in the form of "projects/<project number>/regions/<region>".
+	region, err := d.metadata(ctx, "instance/region")
+	if err != nil {
+		return nil, err
+	}
+	return &monitoredrespb.MonitoredResource{
+		Type: "cloud_run_revision",
+		Labels: map[string]string{
+			"project_id":         projectID,
+			"location":           path.Base(region),
+			"service_name":       getenv("K_SERVICE"),
+			"revision_name":      getenv("K_REVISION"),
+			"configuration_name": getenv("K_CONFIGURATION"),
+		},
+	}, nil
+}
+
+func (d *Detector) k8sContainer(ctx context.Context, projectID string) (*monitoredrespb.MonitoredResource, error) {
+	getenv := d.getenv()
+	clusterName, err := d.metadata(ctx, "instance/attributes/cluster-name")
+	if err != nil {
+		return nil, err
+	}
+	location, err := d.metadata(ctx, "instance/attributes/cluster-location")
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := getenv("NAMESPACE")
+	if namespace == "" {
+		if data, err := d.readFile()(namespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	podName := getenv("POD_NAME")
+	if podName == "" {
+		podName = getenv("HOSTNAME")
+	}
+	return &monitoredrespb.MonitoredResource{
+		Type: "k8s_container",
+		Labels: map[string]string{
+			"project_id":     projectID,
+			"location":       location,
+			"cluster_name":   clusterName,
+			"namespace_name": namespace,
+			"pod_name":       podName,
+			"container_name": getenv("CONTAINER_NAME"),
+		},
+	}, nil
+}
+
+func (d *Detector) gceInstance(ctx context.Context, projectID string) (*monitoredrespb.MonitoredResource, error) {
+	instanceID, err := d.metadata(ctx, "instance/id")
+	if err != nil {
+		return nil, err
+	}
+	// zone is in the form of "projects/<project number>/zones/<zone>".
+	zone, err := d.metadata(ctx, "instance/zone")
+	if err != nil {
+		return nil, err
+	}
+	return &monitoredrespb.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":  projectID,
+			"instance_id": instanceID,
+			"zone":        path.Base(zone),
+		},
+	}, nil
+}
+
+func (d *Detector) genericTask() *monitoredrespb.MonitoredResource {
+	projectID := d.ProjectID
+	if projectID == "" {
+		projectID = d.getenv()("GOOGLE_CLOUD_PROJECT")
+	}
+	location := d.Location
+	if location == "" {
+		location = "global"
+	}
+	job := d.Job
+	if job == "" {
+		job = path.Base(os.Args[0])
+	}
+	taskID := d.TaskID
+	if taskID == "" {
+		hostname, _ := os.Hostname()
+		taskID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	return &monitoredrespb.MonitoredResource{
+		Type: "generic_task",
+		Labels: map[string]string{
+			"project_id": projectID,
+			"location":   location,
+			"namespace":  d.Namespace,
+			"job":        job,
+			"task_id":    taskID,
+		},
+	}
+}
+
+// metadata reads value of the key from the metadata server.
+func (d *Detector) metadata(ctx context.Context, key string) (string, error) {
+	endpoint := d.MetadataEndpoint
+	if endpoint == "" {
+		endpoint = defaultMetadataEndpoint
+	}
+	client := d.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: defaultTimeout}
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(endpoint, "/")+"/computeMetadata/v1/"+key, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to read metadata %s: %s", key, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata %s: %v", key, err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (d *Detector) getenv() func(string) string {
+	if d.Getenv != nil {
+		return d.Getenv
+	}
+	return os.Getenv
+}
+
+func (d *Detector) readFile() func(string) ([]byte, error) {
+	if d.ReadFile != nil {
+		return d.ReadFile
+	}
+	return ioutil.ReadFile
+}
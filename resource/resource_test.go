@@ -0,0 +1,244 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	exporter "github.com/lychung83/stackdriver-exporter"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// newMetadataServer returns a stand-in metadata server serving values in md, keyed by the path
+// under /computeMetadata/v1/.
+func newMetadataServer(t *testing.T, md map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("request to %s has no Metadata-Flavor header", r.URL.Path)
+		}
+		value, ok := md[strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+}
+
+func newGetenv(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func readNoFile(string) ([]byte, error) {
+	return nil, errors.New("no file")
+}
+
+// TestDetect tests that Detector recognizes each supported environment.
+func TestDetect(t *testing.T) {
+	md := map[string]string{
+		"project/project-id":                   "project-1",
+		"instance/id":                          "1234",
+		"instance/zone":                        "projects/5678/zones/us-central1-a",
+		"instance/region":                      "projects/5678/regions/us-central1",
+		"instance/attributes/cluster-name":     "cluster-1",
+		"instance/attributes/cluster-location": "us-central1",
+	}
+	server := newMetadataServer(t, md)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		readFile   func(string) ([]byte, error)
+		wantType   string
+		wantLabels map[string]string
+	}{
+		{
+			name:     "gce_instance",
+			env:      nil,
+			readFile: readNoFile,
+			wantType: "gce_instance",
+			wantLabels: map[string]string{
+				"project_id":  "project-1",
+				"instance_id": "1234",
+				"zone":        "us-central1-a",
+			},
+		},
+		{
+			name: "k8s_container",
+			env: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+				"HOSTNAME":                "pod-1",
+				"CONTAINER_NAME":          "container-1",
+			},
+			readFile: func(filename string) ([]byte, error) {
+				if filename != namespaceFile {
+					return nil, errors.New("no file")
+				}
+				return []byte("namespace-1\n"), nil
+			},
+			wantType: "k8s_container",
+			wantLabels: map[string]string{
+				"project_id":     "project-1",
+				"location":       "us-central1",
+				"cluster_name":   "cluster-1",
+				"namespace_name": "namespace-1",
+				"pod_name":       "pod-1",
+				"container_name": "container-1",
+			},
+		},
+		{
+			name: "cloud_run_revision",
+			env: map[string]string{
+				"K_SERVICE":       "service-1",
+				"K_REVISION":      "service-1-00001",
+				"K_CONFIGURATION": "service-1",
+			},
+			readFile: readNoFile,
+			wantType: "cloud_run_revision",
+			wantLabels: map[string]string{
+				"project_id":         "project-1",
+				"location":           "us-central1",
+				"service_name":       "service-1",
+				"revision_name":      "service-1-00001",
+				"configuration_name": "service-1",
+			},
+		},
+	}
+	for _, test := range tests {
+		d := &Detector{
+			MetadataEndpoint: server.URL,
+			Getenv:           newGetenv(test.env),
+			ReadFile:         test.readFile,
+		}
+		res, err := d.Detect(context.Background())
+		if err != nil {
+			t.Errorf("%s: Detect() failed: %v", test.name, err)
+			continue
+		}
+		if res.Type != test.wantType {
+			t.Errorf("%s: resource type: got %s, want %s", test.name, res.Type, test.wantType)
+		}
+		if !reflect.DeepEqual(res.Labels, test.wantLabels) {
+			t.Errorf("%s: resource labels: got %v, want %v", test.name, res.Labels, test.wantLabels)
+		}
+	}
+}
+
+// TestDetectGenericTask tests that Detector falls back to generic_task when metadata server is
+// not available.
+func TestDetectGenericTask(t *testing.T) {
+	server := newMetadataServer(t, nil)
+	server.Close()
+
+	d := &Detector{
+		MetadataEndpoint: server.URL,
+		Getenv:           newGetenv(map[string]string{"GOOGLE_CLOUD_PROJECT": "project-1"}),
+		ReadFile:         readNoFile,
+		Namespace:        "namespace-1",
+		Job:              "job-1",
+		TaskID:           "task-1",
+	}
+	res, err := d.Detect(context.Background())
+	if err != nil {
+		t.Fatalf("Detect() failed: %v", err)
+	}
+	wantLabels := map[string]string{
+		"project_id": "project-1",
+		"location":   "global",
+		"namespace":  "namespace-1",
+		"job":        "job-1",
+		"task_id":    "task-1",
+	}
+	if res.Type != "generic_task" {
+		t.Errorf("resource type: got %s, want generic_task", res.Type)
+	}
+	if !reflect.DeepEqual(res.Labels, wantLabels) {
+		t.Errorf("resource labels: got %v, want %v", res.Labels, wantLabels)
+	}
+}
+
+// TestMakeResource tests that tags of row data override labels of detected resource.
+func TestMakeResource(t *testing.T) {
+	server := newMetadataServer(t, map[string]string{
+		"project/project-id": "project-1",
+		"instance/id":        "1234",
+		"instance/zone":      "projects/5678/zones/us-central1-a",
+	})
+	defer server.Close()
+
+	zoneKey, err := tag.NewKey("zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := tag.NewKey("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := &exporter.RowData{
+		View: &view.View{Name: "view-1"},
+		Row: &view.Row{
+			Tags: []tag.Tag{{Key: zoneKey, Value: "us-east1-b"}, {Key: otherKey, Value: "value"}},
+		},
+	}
+
+	d := &Detector{MetadataEndpoint: server.URL, Getenv: newGetenv(nil), ReadFile: readNoFile}
+	makeResource := d.MakeResource()
+	res, err := makeResource(rd)
+	if err != nil {
+		t.Fatalf("MakeResource() failed: %v", err)
+	}
+	wantLabels := map[string]string{
+		"project_id":  "project-1",
+		"instance_id": "1234",
+		"zone":        "us-east1-b",
+	}
+	if res.Type != "gce_instance" {
+		t.Errorf("resource type: got %s, want gce_instance", res.Type)
+	}
+	if !reflect.DeepEqual(res.Labels, wantLabels) {
+		t.Errorf("resource labels: got %v, want %v", res.Labels, wantLabels)
+	}
+	// Detected resource must not be modified by the override.
+	if d.resource.Labels["zone"] != "us-central1-a" {
+		t.Errorf("detected resource is modified: %v", d.resource.Labels)
+	}
+}
+
+// TestMakeResourceRetry tests that failures of detection are not cached, and that detection is
+// retried until it succeeds.
+func TestMakeResourceRetry(t *testing.T) {
+	// The zone is missing, so detection of gce_instance fails.
+	failingServer := newMetadataServer(t, map[string]string{
+		"project/project-id": "project-1",
+		"instance/id":        "1234",
+	})
+	defer failingServer.Close()
+	server := newMetadataServer(t, map[string]string{
+		"project/project-id": "project-1",
+		"instance/id":        "1234",
+		"instance/zone":      "projects/5678/zones/us-central1-a",
+	})
+	defer server.Close()
+
+	rd := &exporter.RowData{View: &view.View{Name: "view-1"}, Row: &view.Row{}}
+	d := &Detector{MetadataEndpoint: failingServer.URL, Getenv: newGetenv(nil), ReadFile: readNoFile}
+	makeResource := d.MakeResource()
+	if _, err := makeResource(rd); err == nil {
+		t.Fatal("MakeResource() succeeded without the zone")
+	}
+	// The metadata server recovers.
+	d.MetadataEndpoint = server.URL
+	res, err := makeResource(rd)
+	if err != nil {
+		t.Fatalf("MakeResource() failed after the metadata server recovered: %v", err)
+	}
+	if res.Type != "gce_instance" {
+		t.Errorf("resource type: got %s, want gce_instance", res.Type)
+	}
+}
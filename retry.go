@@ -0,0 +1,129 @@
+package exporter
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/lychung83/stackdriver-exporter/observability"
+	cloudtracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// default values for retry options.
+const (
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+)
+
+// retryable tells whether an RPC call that failed with err is worth retrying.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// We wrap sleeping between retries for testing.
+var retrySleep = defaultRetrySleep
+
+// defaultRetrySleep waits for d, or until ctx is done. In the latter case, error of ctx is
+// returned.
+func defaultRetrySleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryOptions designates how failed RPC calls are retried. See retry options of Options for the
+// meaning of each field.
+type retryOptions struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	timeout        time.Duration
+}
+
+// retryCall makes an RPC call by call, and retries it with jittered exponential backoff as
+// designated by opts. ctx is passed to call, bounded by the timeout of opts. When all attempts
+// fail, the error of the last attempt is returned.
+func retryCall(ctx context.Context, opts retryOptions, call func(context.Context) error) error {
+	if 0 < opts.timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	backoff := opts.initialBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryInitialBackoff
+	}
+	maxBackoff := opts.maxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := call(ctx)
+		if err == nil || !retryable(err) || opts.maxAttempts <= attempt {
+			return err
+		}
+		// We use "full jitter", that is, actual wait time is uniformly distributed in
+		// [0, backoff).
+		if sleepErr := retrySleep(ctx, time.Duration(rand.Int63n(int64(backoff)))); sleepErr != nil {
+			// Time budget is exhausted, so we give up.
+			return err
+		}
+		if backoff *= 2; maxBackoff < backoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// createTimeSeries makes RPC call to create time series, and retries it as designated by retry
+// options of the exporter. When all attempts fail, the error of the last attempt is returned.
+func (pd *projectData) createTimeSeries(req *monitoringpb.CreateTimeSeriesRequest) error {
+	exp := pd.parent
+	opts := exp.opts
+	client, err := pd.metricClient()
+	if err != nil {
+		return err
+	}
+
+	retryOpts := retryOptions{
+		maxAttempts:    opts.RetryMaxAttempts,
+		initialBackoff: opts.RetryInitialBackoff,
+		maxBackoff:     opts.RetryMaxBackoff,
+		timeout:        opts.RetryTimeout,
+	}
+	return retryCall(exp.ctx, retryOpts, func(ctx context.Context) error {
+		start := time.Now()
+		err := client.CreateTimeSeries(ctx, req)
+		observability.RecordRPC(exp.ctx, pd.projectID, status.Code(err), time.Since(start))
+		return err
+	})
+}
+
+// writeSpans makes RPC call to write spans, and retries it as designated by retry options of the
+// trace exporter. When all attempts fail, the error of the last attempt is returned.
+func (pd *traceProjectData) writeSpans(req *cloudtracepb.BatchWriteSpansRequest) error {
+	exp := pd.parent
+	opts := exp.opts
+	retryOpts := retryOptions{
+		maxAttempts:    opts.RetryMaxAttempts,
+		initialBackoff: opts.RetryInitialBackoff,
+		maxBackoff:     opts.RetryMaxBackoff,
+		timeout:        opts.RetryTimeout,
+	}
+	return retryCall(exp.ctx, retryOpts, func(ctx context.Context) error {
+		return exp.client.BatchWriteSpans(ctx, req)
+	})
+}
@@ -0,0 +1,284 @@
+// Package routing builds GetProjectID, MakeResource and UnexportedLabels of exporter options from
+// declarative rules, which can be written in JSON or YAML. A typical config looks like:
+//
+//	rules:
+//	- view: "myservice/*"
+//	  tags:
+//	    env: "prod*"
+//	  projectTag: project_id
+//	  resource:
+//	    type: generic_task
+//	    labels:
+//	      location: global
+//	    labelTags:
+//	      job: job_name
+//	      task_id: task
+//	- project: fallback-project
+//
+// Rules are checked in order, and the first rule matching the row data is used. Patterns follow
+// path.Match, where "*" doesn't match "/". Thus "myservice/*" above matches view
+// "myservice/latency", but not "myservice/rpc/latency", which needs "myservice/*/*".
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	exporter "github.com/lychung83/stackdriver-exporter"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is a set of routing rules.
+type Config struct {
+	// Rules are checked in order against each row data, and the first matching rule determines
+	// project and resource of the row data. Row data matching no rule is not applicable to the
+	// exporter.
+	Rules []*Rule `json:"rules" yaml:"rules"`
+	// UnexportedLabels are added to UnexportedLabels of exporter options, in addition to tag keys
+	// used by ProjectTag and LabelTags of the rules.
+	UnexportedLabels []string `json:"unexportedLabels" yaml:"unexportedLabels"`
+}
+
+// Rule matches row data and determines its project and resource.
+type Rule struct {
+	// View is a pattern of view names in the syntax of path.Match. View names are matched as
+	// paths, so "*" matches a single segment and doesn't match "/". Empty pattern matches all
+	// views.
+	View string `json:"view" yaml:"view"`
+	// Tags maps tag keys to patterns of tag values in the syntax of path.Match. Row data matches
+	// the rule only if it has all the tags with matching values.
+	Tags map[string]string `json:"tags" yaml:"tags"`
+
+	// Drop makes matching row data not applicable to the exporter. Project and Resource must
+	// not be set with Drop.
+	Drop bool `json:"drop" yaml:"drop"`
+	// Project is the project ID of matching row data. Exactly one of Project and ProjectTag
+	// must be set unless Drop is set.
+	Project string `json:"project" yaml:"project"`
+	// ProjectTag is the tag key whose value is used as the project ID of matching row data.
+	ProjectTag string `json:"projectTag" yaml:"projectTag"`
+	// Resource determines monitored resource of matching row data. When not set, global
+	// resource is used.
+	Resource *Resource `json:"resource" yaml:"resource"`
+}
+
+// Resource determines monitored resource of row data.
+type Resource struct {
+	// Type is the monitored resource type, like "gce_instance".
+	Type string `json:"type" yaml:"type"`
+	// Labels are resource labels with constant values.
+	Labels map[string]string `json:"labels" yaml:"labels"`
+	// LabelTags maps resource label keys to tag keys whose values are used as label values.
+	// Row data without the tag is reported as an error.
+	LabelTags map[string]string `json:"labelTags" yaml:"labelTags"`
+}
+
+// ParseJSON parses config written in JSON. Like ParseYAML, unknown fields are rejected.
+func ParseJSON(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse routing config: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("failed to parse routing config: unexpected data after config")
+	}
+	return cfg, nil
+}
+
+// ParseYAML parses config written in YAML.
+func ParseYAML(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse routing config: %v", err)
+	}
+	return cfg, nil
+}
+
+// LoadFile reads config from the file and compiles it. Files with ".json" extension are parsed
+// as JSON, and others as YAML.
+func LoadFile(filename string) (*Router, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing config: %v", err)
+	}
+	var cfg *Config
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		cfg, err = ParseJSON(data)
+	} else {
+		cfg, err = ParseYAML(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Compile()
+}
+
+// Router routes row data according to validated config.
+type Router struct {
+	rules            []*Rule
+	unexportedLabels []string
+}
+
+// Compile validates the config and returns a Router for it. Config must not be modified after
+// the call.
+func (cfg *Config) Compile() (*Router, error) {
+	unexported := make(map[string]bool)
+	for _, key := range cfg.UnexportedLabels {
+		unexported[key] = true
+	}
+	for i, rule := range cfg.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid routing rule %d: %v", i, err)
+		}
+		if rule.ProjectTag != "" {
+			unexported[rule.ProjectTag] = true
+		}
+		if rule.Resource != nil {
+			for _, tagKey := range rule.Resource.LabelTags {
+				unexported[tagKey] = true
+			}
+		}
+	}
+
+	r := &Router{rules: cfg.Rules}
+	for key := range unexported {
+		r.unexportedLabels = append(r.unexportedLabels, key)
+	}
+	sort.Strings(r.unexportedLabels)
+	return r, nil
+}
+
+func (rule *Rule) validate() error {
+	if rule == nil {
+		return fmt.Errorf("empty rule")
+	}
+	if _, err := path.Match(rule.View, ""); err != nil {
+		return fmt.Errorf("bad view pattern %q: %v", rule.View, err)
+	}
+	for key, pattern := range rule.Tags {
+		if key == "" {
+			return fmt.Errorf("empty tag key")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q of tag %s: %v", pattern, key, err)
+		}
+	}
+
+	if rule.Drop {
+		if rule.Project != "" || rule.ProjectTag != "" || rule.Resource != nil {
+			return fmt.Errorf("project and resource must not be set with drop")
+		}
+		return nil
+	}
+	if (rule.Project == "") == (rule.ProjectTag == "") {
+		return fmt.Errorf("exactly one of project and projectTag must be set")
+	}
+	if res := rule.Resource; res != nil {
+		if res.Type == "" {
+			return fmt.Errorf("empty resource type")
+		}
+		for key, tagKey := range res.LabelTags {
+			if _, ok := res.Labels[key]; ok {
+				return fmt.Errorf("resource label %s is set by both labels and labelTags", key)
+			}
+			if tagKey == "" {
+				return fmt.Errorf("empty tag key of resource label %s", key)
+			}
+		}
+	}
+	return nil
+}
+
+// UnexportedLabels returns UnexportedLabels of the config, together with tag keys used for
+// project IDs and resource labels.
+func (r *Router) UnexportedLabels() []string {
+	return append([]string(nil), r.unexportedLabels...)
+}
+
+// Apply sets GetProjectID and MakeResource of opts, and adds unexported labels of the router to
+// UnexportedLabels of opts.
+func (r *Router) Apply(opts *exporter.Options) {
+	opts.GetProjectID = r.GetProjectID
+	opts.MakeResource = r.MakeResource
+	opts.UnexportedLabels = append(opts.UnexportedLabels, r.unexportedLabels...)
+}
+
+// GetProjectID can be used as GetProjectID of exporter options.
+func (r *Router) GetProjectID(rd *exporter.RowData) (string, error) {
+	rule, tags := r.match(rd)
+	if rule == nil || rule.Drop {
+		return "", exporter.RowDataNotApplicableError
+	}
+	if rule.Project != "" {
+		return rule.Project, nil
+	}
+	projectID, ok := tags[rule.ProjectTag]
+	if !ok || projectID == "" {
+		return "", fmt.Errorf("row data of view %s has no tag %s for project ID", rd.View.Name, rule.ProjectTag)
+	}
+	return projectID, nil
+}
+
+// MakeResource can be used as MakeResource of exporter options.
+func (r *Router) MakeResource(rd *exporter.RowData) (*monitoredrespb.MonitoredResource, error) {
+	rule, tags := r.match(rd)
+	if rule == nil || rule.Resource == nil {
+		return &monitoredrespb.MonitoredResource{Type: "global"}, nil
+	}
+	res := rule.Resource
+	labels := make(map[string]string, len(res.Labels)+len(res.LabelTags))
+	for key, value := range res.Labels {
+		labels[key] = value
+	}
+	for key, tagKey := range res.LabelTags {
+		value, ok := tags[tagKey]
+		if !ok {
+			return nil, fmt.Errorf("row data of view %s has no tag %s for resource label %s", rd.View.Name, tagKey, key)
+		}
+		labels[key] = value
+	}
+	return &monitoredrespb.MonitoredResource{Type: res.Type, Labels: labels}, nil
+}
+
+// match returns the first rule matching rd, together with tags of rd as a map.
+func (r *Router) match(rd *exporter.RowData) (*Rule, map[string]string) {
+	tags := make(map[string]string, len(rd.Row.Tags))
+	for _, tag := range rd.Row.Tags {
+		tags[tag.Key.Name()] = tag.Value
+	}
+	for _, rule := range r.rules {
+		if rule.matches(rd.View.Name, tags) {
+			return rule, tags
+		}
+	}
+	return nil, tags
+}
+
+func (rule *Rule) matches(viewName string, tags map[string]string) bool {
+	// Patterns are validated by Compile, so errors are not possible here.
+	if rule.View != "" {
+		if ok, _ := path.Match(rule.View, viewName); !ok {
+			return false
+		}
+	}
+	for key, pattern := range rule.Tags {
+		value, ok := tags[key]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+	return true
+}
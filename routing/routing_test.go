@@ -0,0 +1,171 @@
+package routing
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	exporter "github.com/lychung83/stackdriver-exporter"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const yamlConfig = `
+rules:
+- view: "myservice/*"
+  tags:
+    env: "prod*"
+  projectTag: project_id
+  resource:
+    type: generic_task
+    labels:
+      location: global
+    labelTags:
+      job: job_name
+- view: "debug/*"
+  drop: true
+- project: fallback-project
+unexportedLabels:
+- secret
+`
+
+func newRowData(t *testing.T, viewName string, tags map[string]string) *exporter.RowData {
+	row := &view.Row{}
+	for name, value := range tags {
+		key, err := tag.NewKey(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row.Tags = append(row.Tags, tag.Tag{Key: key, Value: value})
+	}
+	return &exporter.RowData{View: &view.View{Name: viewName}, Row: row}
+}
+
+// TestRouter tests that row data are routed by the first matching rule.
+func TestRouter(t *testing.T) {
+	cfg, err := ParseYAML([]byte(yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := cfg.Compile()
+	if err != nil {
+		t.Fatalf("Compile() failed: %v", err)
+	}
+
+	opts := &exporter.Options{UnexportedLabels: []string{"other"}}
+	r.Apply(opts)
+	wantUnexported := []string{"other", "job_name", "project_id", "secret"}
+	if !reflect.DeepEqual(opts.UnexportedLabels, wantUnexported) {
+		t.Errorf("UnexportedLabels: got %v, want %v", opts.UnexportedLabels, wantUnexported)
+	}
+
+	rd := newRowData(t, "myservice/latency", map[string]string{
+		"env":        "production",
+		"project_id": "project-1",
+		"job_name":   "job-1",
+	})
+	projectID, err := opts.GetProjectID(rd)
+	if err != nil || projectID != "project-1" {
+		t.Errorf("GetProjectID(): got (%s, %v), want (project-1, <nil>)", projectID, err)
+	}
+	res, err := opts.MakeResource(rd)
+	if err != nil {
+		t.Fatalf("MakeResource() failed: %v", err)
+	}
+	wantLabels := map[string]string{"location": "global", "job": "job-1"}
+	if res.Type != "generic_task" || !reflect.DeepEqual(res.Labels, wantLabels) {
+		t.Errorf("MakeResource(): got %v, want generic_task with labels %v", res, wantLabels)
+	}
+
+	// Tag value not matching the pattern falls through to the last rule.
+	rd = newRowData(t, "myservice/latency", map[string]string{"env": "dev", "project_id": "project-1"})
+	projectID, err = opts.GetProjectID(rd)
+	if err != nil || projectID != "fallback-project" {
+		t.Errorf("GetProjectID(): got (%s, %v), want (fallback-project, <nil>)", projectID, err)
+	}
+	res, err = opts.MakeResource(rd)
+	if err != nil || res.Type != "global" {
+		t.Errorf("MakeResource(): got (%v, %v), want global resource", res, err)
+	}
+
+	rd = newRowData(t, "debug/count", nil)
+	if _, err := opts.GetProjectID(rd); err != exporter.RowDataNotApplicableError {
+		t.Errorf("GetProjectID(): got error %v, want %v", err, exporter.RowDataNotApplicableError)
+	}
+
+	// Missing tags used by a matching rule are errors.
+	rd = newRowData(t, "myservice/latency", map[string]string{"env": "prod", "project_id": "project-1"})
+	if _, err := opts.MakeResource(rd); err == nil {
+		t.Error("MakeResource() succeeded, want error on missing tag job_name")
+	}
+}
+
+// TestParseJSON tests that JSON config is parsed the same way as YAML.
+func TestParseJSON(t *testing.T) {
+	cfg, err := ParseJSON([]byte(`{"rules": [{"view": "a/*", "project": "project-1"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{Rules: []*Rule{{View: "a/*", Project: "project-1"}}}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config: got %+v, want %+v", cfg, want)
+	}
+
+	// Unknown fields, like misspelled ones, and data after the config are rejected.
+	for _, data := range []string{
+		`{"rules": [{"veiw": "a/*", "project": "project-1"}]}`,
+		`{"rules": []} {}`,
+	} {
+		if _, err := ParseJSON([]byte(data)); err == nil {
+			t.Errorf("ParseJSON(%s) succeeded, want error", data)
+		}
+	}
+}
+
+// TestViewPatternSegments tests that "*" in view patterns doesn't match "/".
+func TestViewPatternSegments(t *testing.T) {
+	r, err := (&Config{Rules: []*Rule{{View: "a/*", Project: "project-1"}}}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if projectID, err := r.GetProjectID(newRowData(t, "a/b", nil)); err != nil || projectID != "project-1" {
+		t.Errorf("GetProjectID(a/b): got (%s, %v), want (project-1, <nil>)", projectID, err)
+	}
+	if _, err := r.GetProjectID(newRowData(t, "a/b/c", nil)); err != exporter.RowDataNotApplicableError {
+		t.Errorf("GetProjectID(a/b/c): got error %v, want %v", err, exporter.RowDataNotApplicableError)
+	}
+}
+
+// TestCompileError tests that invalid rules are rejected.
+func TestCompileError(t *testing.T) {
+	tests := []struct {
+		rule    *Rule
+		wantErr string
+	}{
+		{&Rule{}, "exactly one of project and projectTag"},
+		{&Rule{Project: "p", ProjectTag: "t"}, "exactly one of project and projectTag"},
+		{&Rule{View: "[", Project: "p"}, "bad view pattern"},
+		{&Rule{Tags: map[string]string{"k": "["}, Project: "p"}, "bad pattern"},
+		{&Rule{Drop: true, Project: "p"}, "must not be set with drop"},
+		{&Rule{Project: "p", Resource: &Resource{}}, "empty resource type"},
+		{
+			&Rule{Project: "p", Resource: &Resource{
+				Type:      "generic_task",
+				Labels:    map[string]string{"job": "job-1"},
+				LabelTags: map[string]string{"job": "job_name"},
+			}},
+			"set by both labels and labelTags",
+		},
+	}
+	for i, test := range tests {
+		cfg := &Config{Rules: []*Rule{{Project: "ok"}, test.rule}}
+		_, err := cfg.Compile()
+		if err == nil {
+			t.Errorf("test %d: Compile() succeeded, want error", i)
+			continue
+		}
+		if !strings.Contains(err.Error(), "rule 1") || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("test %d: got error %q, want error of rule 1 containing %q", i, err, test.wantErr)
+		}
+	}
+}
@@ -75,11 +75,8 @@ func newTypedValue(vd *view.View, r *view.Row) *monitoringpb.TypedValue {
 				Count:                 v.Count,
 				Mean:                  v.Mean,
 				SumOfSquaredDeviation: v.SumOfSquaredDev,
-				// TODO(songya): uncomment this once Stackdriver supports min/max.
-				// Range: &distributionpb.Distribution_Range{
-				//      Min: v.Min,
-				//      Max: v.Max,
-				// },
+				// Range and exemplars are added by projectData.decorateDistribution() as
+				// designated by options.
 				BucketOptions: &distributionpb.Distribution_BucketOptions{
 					Options: &distributionpb.Distribution_BucketOptions_ExplicitBuckets{
 						ExplicitBuckets: &distributionpb.Distribution_BucketOptions_Explicit{
@@ -0,0 +1,50 @@
+package exporter
+
+import (
+	"context"
+
+	gax "github.com/googleapis/gax-go"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Sink receives time series made by the exporter, in place of stackdriver. See Sink of Options.
+type Sink interface {
+	// Export receives time series of the project, and row data that they are made from.
+	// timeSeries[i] is made from rds[i], and there are at most MaxTimeSeriesPerUpload of them.
+	// Neither time series nor row data must be modified. Error returned is reported via OnError
+	// with rds.
+	Export(projectID string, timeSeries []*monitoringpb.TimeSeries, rds []*RowData) error
+}
+
+// sinkClient is the metric client of exporters with Sink option, which don't make RPC calls.
+type sinkClient struct{}
+
+var errSinkClient = status.Error(codes.Unimplemented, "stackdriver is not available with Sink option")
+
+func (sinkClient) CreateTimeSeries(context.Context, *monitoringpb.CreateTimeSeriesRequest, ...gax.CallOption) error {
+	return errSinkClient
+}
+
+func (sinkClient) CreateMetricDescriptor(context.Context, *monitoringpb.CreateMetricDescriptorRequest, ...gax.CallOption) (*metricpb.MetricDescriptor, error) {
+	return nil, errSinkClient
+}
+
+func (sinkClient) GetMetricDescriptor(context.Context, *monitoringpb.GetMetricDescriptorRequest, ...gax.CallOption) (*metricpb.MetricDescriptor, error) {
+	return nil, errSinkClient
+}
+
+func (sinkClient) Close() error {
+	return nil
+}
+
+// upload uploads time series of req made from reqRds, to Sink when it's set, or to stackdriver
+// otherwise.
+func (pd *projectData) upload(req *monitoringpb.CreateTimeSeriesRequest, reqRds []*RowData) error {
+	if sink := pd.parent.opts.Sink; sink != nil {
+		return sink.Export(pd.projectID, req.TimeSeries, reqRds)
+	}
+	return pd.createTimeSeries(req)
+}
@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	timestamppb "github.com/golang/protobuf/ptypes/timestamp"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+	"go.opencensus.io/trace"
+	cloudtracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// Functions in this file is used to convert SpanData to spans that are used by uploading RPC calls
+// of trace client. They are modelled after contrib.go.opencensus.io/exporter/stackdriver.
+
+// limits of string lengths in bytes, which are enforced by cloud trace.
+const (
+	maxDisplayNameLen    = 128
+	maxAttributeValueLen = 256
+	maxAnnotationLen     = 256
+)
+
+func newSpan(sd *trace.SpanData, projectID string) *cloudtracepb.Span {
+	traceID := sd.SpanContext.TraceID.String()
+	spanID := sd.SpanContext.SpanID.String()
+	span := &cloudtracepb.Span{
+		Name:                    fmt.Sprintf("projects/%s/traces/%s/spans/%s", projectID, traceID, spanID),
+		SpanId:                  spanID,
+		DisplayName:             newTruncatableString(sd.Name, maxDisplayNameLen),
+		StartTime:               newTimestamp(sd.StartTime),
+		EndTime:                 newTimestamp(sd.EndTime),
+		SameProcessAsParentSpan: &wrapperspb.BoolValue{Value: !sd.HasRemoteParent},
+		Attributes:              newSpanAttributes(sd.Attributes),
+	}
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanId = sd.ParentSpanID.String()
+	}
+	if sd.Status.Code != trace.StatusCodeOK || sd.Status.Message != "" {
+		span.Status = &statuspb.Status{
+			Code:    sd.Status.Code,
+			Message: sd.Status.Message,
+		}
+	}
+
+	var timeEvents []*cloudtracepb.Span_TimeEvent
+	for _, annotation := range sd.Annotations {
+		timeEvents = append(timeEvents, &cloudtracepb.Span_TimeEvent{
+			Time: newTimestamp(annotation.Time),
+			Value: &cloudtracepb.Span_TimeEvent_Annotation_{
+				Annotation: &cloudtracepb.Span_TimeEvent_Annotation{
+					Description: newTruncatableString(annotation.Message, maxAnnotationLen),
+					Attributes:  newSpanAttributes(annotation.Attributes),
+				},
+			},
+		})
+	}
+	for _, event := range sd.MessageEvents {
+		timeEvents = append(timeEvents, &cloudtracepb.Span_TimeEvent{
+			Time: newTimestamp(event.Time),
+			Value: &cloudtracepb.Span_TimeEvent_MessageEvent_{
+				MessageEvent: &cloudtracepb.Span_TimeEvent_MessageEvent{
+					Type:                  cloudtracepb.Span_TimeEvent_MessageEvent_Type(event.EventType),
+					Id:                    event.MessageID,
+					UncompressedSizeBytes: event.UncompressedByteSize,
+					CompressedSizeBytes:   event.CompressedByteSize,
+				},
+			},
+		})
+	}
+	if len(timeEvents) != 0 {
+		span.TimeEvents = &cloudtracepb.Span_TimeEvents{TimeEvent: timeEvents}
+	}
+
+	if len(sd.Links) != 0 {
+		span.Links = &cloudtracepb.Span_Links{}
+		for _, link := range sd.Links {
+			span.Links.Link = append(span.Links.Link, &cloudtracepb.Span_Link{
+				TraceId:    link.TraceID.String(),
+				SpanId:     link.SpanID.String(),
+				Type:       cloudtracepb.Span_Link_Type(link.Type),
+				Attributes: newSpanAttributes(link.Attributes),
+			})
+		}
+	}
+	return span
+}
+
+func newTimestamp(t time.Time) *timestamppb.Timestamp {
+	return &timestamppb.Timestamp{
+		Seconds: t.Unix(),
+		Nanos:   int32(t.Nanosecond()),
+	}
+}
+
+// newTruncatableString truncates s to be at most limit bytes without breaking UTF-8 encoding.
+func newTruncatableString(s string, limit int) *cloudtracepb.TruncatableString {
+	if len(s) <= limit {
+		return &cloudtracepb.TruncatableString{Value: s}
+	}
+	end := limit
+	for 0 < end && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return &cloudtracepb.TruncatableString{
+		Value:              s[:end],
+		TruncatedByteCount: int32(len(s) - end),
+	}
+}
+
+func newSpanAttributes(attributes map[string]interface{}) *cloudtracepb.Span_Attributes {
+	if len(attributes) == 0 {
+		return nil
+	}
+	attrMap := make(map[string]*cloudtracepb.AttributeValue, len(attributes))
+	for key, value := range attributes {
+		switch v := value.(type) {
+		case bool:
+			attrMap[key] = &cloudtracepb.AttributeValue{
+				Value: &cloudtracepb.AttributeValue_BoolValue{BoolValue: v},
+			}
+		case int64:
+			attrMap[key] = &cloudtracepb.AttributeValue{
+				Value: &cloudtracepb.AttributeValue_IntValue{IntValue: v},
+			}
+		default:
+			// Cloud trace supports only bool, int and string values, so all others are
+			// converted to string.
+			attrMap[key] = &cloudtracepb.AttributeValue{
+				Value: &cloudtracepb.AttributeValue_StringValue{
+					StringValue: newTruncatableString(fmt.Sprint(v), maxAttributeValueLen),
+				},
+			}
+		}
+	}
+	return &cloudtracepb.Span_Attributes{AttributeMap: attrMap}
+}
@@ -0,0 +1,437 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// stackdriver rejects points older than 25 hours.
+const maxPointAge = 25 * time.Hour
+
+// default values for spool options.
+const (
+	defaultSpoolMaxBytes = 64 << 20
+	defaultSpoolMaxAge   = maxPointAge
+)
+
+const (
+	spoolFileExt = ".pb"
+	spoolTmpExt  = ".tmp"
+)
+
+// spoolProjectIDRegexp matches GCP project IDs, optionally scoped by a domain like
+// "example.com:my-project". Project IDs are used as directory names in the spool, so they must not
+// contain path separators or be "." or "..".
+var spoolProjectIDRegexp = regexp.MustCompile(`^([a-z0-9.-]+:)?[a-z][a-z0-9-]*[a-z0-9]$`)
+
+// spool persists create time series requests that could not be uploaded in a directory, and
+// replays them later. Requests of each project are stored in a subdirectory named by the project
+// ID, and each request is stored in a file whose name starts with its creation time, so that
+// requests can be replayed in order. Spooled files are also indexed in memory, so that limits of
+// the spool are enforced without reading the directory. spool should be created by newSpool().
+type spool struct {
+	exp      *StatsExporter
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	// mu protects all fields below, and files in dir.
+	mu sync.Mutex
+	// seq distinguishes files created at the same time.
+	seq uint64
+	// files holds spooled files of each project, in the order they are written. Projects without
+	// spooled files are not in files.
+	files map[string][]spoolFile
+	// size is the total size of spooled files.
+	size int64
+	// pending holds projects whose spooled requests should be replayed.
+	pending map[string]bool
+	// wake notifies the replaying goroutine that pending is updated.
+	wake chan struct{}
+}
+
+func newSpool(exp *StatsExporter) *spool {
+	opts := exp.opts
+	s := &spool{
+		exp:      exp,
+		dir:      opts.SpoolDir,
+		maxBytes: opts.SpoolMaxBytes,
+		maxAge:   opts.SpoolMaxAge,
+		files:    make(map[string][]spoolFile),
+		pending:  make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultSpoolMaxBytes
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultSpoolMaxAge
+	}
+	return s
+}
+
+// start schedules replaying requests spooled by previous runs, and starts the goroutine replaying
+// spooled requests. The goroutine stops when the exporter is closed.
+func (s *spool) start() error {
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	exp := s.exp
+	exp.wg.Add(1)
+	go func() {
+		defer exp.wg.Done()
+		for {
+			select {
+			case <-s.wake:
+				s.replayPending()
+			case <-exp.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// load indexes files spooled by previous runs, and schedules replaying them.
+func (s *spool) load() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() || !spoolProjectIDRegexp.MatchString(info.Name()) {
+			continue
+		}
+		projectID := info.Name()
+		files := readSpoolDir(filepath.Join(s.dir, projectID), projectID)
+		if len(files) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		s.files[projectID] = files
+		for _, file := range files {
+			s.size += file.size
+		}
+		s.mu.Unlock()
+		s.notify(projectID)
+	}
+	return nil
+}
+
+// notify schedules replaying spooled requests of the project, if there are any.
+func (s *spool) notify(projectID string) {
+	s.mu.Lock()
+	if len(s.files[projectID]) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.pending[projectID] = true
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// The replaying goroutine is already notified.
+	}
+}
+
+// replayPending replays spooled requests of all pending projects.
+func (s *spool) replayPending() {
+	s.mu.Lock()
+	projectIDs := make([]string, 0, len(s.pending))
+	for projectID := range s.pending {
+		projectIDs = append(projectIDs, projectID)
+	}
+	s.pending = make(map[string]bool)
+	s.mu.Unlock()
+
+	for _, projectID := range projectIDs {
+		s.replay(s.exp.getProjectData(projectID))
+	}
+}
+
+// write persists req for the project. The project ID must be a valid GCP project ID.
+func (s *spool) write(projectID string, req *monitoringpb.CreateTimeSeriesRequest) error {
+	if !spoolProjectIDRegexp.MatchString(projectID) {
+		return fmt.Errorf("invalid project ID %q for spool directory", projectID)
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	projDir := filepath.Join(s.dir, projectID)
+	if err := os.MkdirAll(projDir, 0755); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.seq++
+	// The time of writing is kept in the file name, since modification time of the file may be
+	// changed by others.
+	written := time.Now()
+	path := filepath.Join(projDir, fmt.Sprintf("%020d-%010d%s", written.UnixNano(), s.seq, spoolFileExt))
+	// We write to a temporary file first, so that a partially written file is never replayed.
+	tmpPath := path + spoolTmpExt
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		os.Remove(tmpPath)
+		s.mu.Unlock()
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		s.mu.Unlock()
+		return err
+	}
+	s.files[projectID] = append(s.files[projectID], spoolFile{projectID, path, int64(len(data)), written})
+	s.size += int64(len(data))
+	drops := s.enforceLimits()
+	s.mu.Unlock()
+
+	// We report drops outside of the lock, since OnSpoolError is provided by users.
+	for _, drop := range drops {
+		s.exp.onSpoolError(drop.err, drop.projectID, drop.timeSeries)
+	}
+	return nil
+}
+
+// spoolDrop is a spooled request dropped from the spool, to be reported via OnSpoolError.
+type spoolDrop struct {
+	err        error
+	projectID  string
+	timeSeries []*monitoringpb.TimeSeries
+}
+
+// spoolFile is a file containing a spooled request. written is the time of writing the file, which
+// is zero when it can't be told from the file name.
+type spoolFile struct {
+	projectID string
+	path      string
+	size      int64
+	written   time.Time
+}
+
+// readSpoolDir lists spooled files of the project in the directory, in the order they are written.
+// It's used for files spooled by previous runs.
+func readSpoolDir(projDir, projectID string) []spoolFile {
+	// ReadDir returns files sorted by name, which is also the order of writing.
+	infos, err := ioutil.ReadDir(projDir)
+	if err != nil {
+		return nil
+	}
+	var files []spoolFile
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), spoolFileExt) {
+			continue
+		}
+		files = append(files, spoolFile{projectID, filepath.Join(projDir, info.Name()), info.Size(), spoolFileTime(info.Name())})
+	}
+	return files
+}
+
+// removeFile removes file from the spool, unless it's already removed. s.mu must be held by the
+// caller.
+func (s *spool) removeFile(file spoolFile) {
+	files := s.files[file.projectID]
+	for i := range files {
+		if files[i].path != file.path {
+			continue
+		}
+		os.Remove(file.path)
+		s.size -= file.size
+		if len(files) == 1 {
+			delete(s.files, file.projectID)
+		} else {
+			s.files[file.projectID] = append(files[:i:i], files[i+1:]...)
+		}
+		return
+	}
+}
+
+// spoolFileTime returns the time of writing a spooled file from its name, which starts with the
+// time in nanoseconds. It returns zero time when the name is not in the form.
+func spoolFileTime(name string) time.Time {
+	pos := strings.Index(name, "-")
+	if pos < 0 {
+		return time.Time{}
+	}
+	nanos, err := strconv.ParseInt(name[:pos], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// oldestFile returns the oldest spooled file, which is the first file of some project. ok is false
+// when there are no spooled files. s.mu must be held by the caller.
+func (s *spool) oldestFile() (oldest spoolFile, ok bool) {
+	for _, files := range s.files {
+		// Since file names start with the time of writing, the oldest file has the smallest
+		// name.
+		if file := files[0]; !ok || filepath.Base(file.path) < filepath.Base(oldest.path) {
+			oldest, ok = file, true
+		}
+	}
+	return oldest, ok
+}
+
+// enforceLimits drops spooled requests that are too old, and drops oldest requests until total
+// size of spooled requests fits in the limit. Files whose time of writing is unknown are
+// considered too old. It returns dropped requests, which the caller must report after releasing
+// s.mu. s.mu must be held by the caller.
+func (s *spool) enforceLimits() []spoolDrop {
+	cutoff := time.Now().Add(-s.maxAge)
+	var drops []spoolDrop
+	for {
+		file, ok := s.oldestFile()
+		if !ok {
+			break
+		}
+		tooOld := file.written.Before(cutoff)
+		if !tooOld && s.size <= s.maxBytes {
+			break
+		}
+		// Time series are read before removing the file, so that they can be reported.
+		var timeSeries []*monitoringpb.TimeSeries
+		if req, err := readSpoolFile(file.path); err == nil {
+			timeSeries = req.TimeSeries
+		}
+		s.removeFile(file)
+		var reason string
+		if tooOld {
+			reason = fmt.Sprintf("it is older than %v", s.maxAge)
+		} else {
+			reason = fmt.Sprintf("spool size exceeds %d bytes", s.maxBytes)
+		}
+		drops = append(drops, spoolDrop{
+			err:        fmt.Errorf("dropped spooled request for project %s because %s", file.projectID, reason),
+			projectID:  file.projectID,
+			timeSeries: timeSeries,
+		})
+	}
+	return drops
+}
+
+// replay uploads spooled requests of the project of pd in order, so that they are retried, rate
+// limited and recorded like any other requests. It stops when an upload fails with retryable error
+// or exceeds the rate limit of the project, leaving the rest of requests for the next replay. It
+// returns true when no spooled requests of the project are left. Uploads of the project call
+// replay before sending new requests, since stackdriver rejects points older than the last point
+// of their series.
+func (s *spool) replay(pd *projectData) bool {
+	exp := s.exp
+	projectID := pd.projectID
+	s.mu.Lock()
+	spooled := len(s.files[projectID]) != 0
+	s.mu.Unlock()
+	if !spooled {
+		return true
+	}
+
+	pd.replayMu.Lock()
+	defer pd.replayMu.Unlock()
+	for {
+		select {
+		case <-exp.done:
+			return false
+		default:
+		}
+
+		s.mu.Lock()
+		files := s.files[projectID]
+		if len(files) == 0 {
+			s.mu.Unlock()
+			return true
+		}
+		file := files[0]
+		s.mu.Unlock()
+
+		req, err := readSpoolFile(file.path)
+		if err != nil {
+			exp.onSpoolError(fmt.Errorf("dropped spooled request for project %s because reading it failed: %v", projectID, err), projectID, nil)
+		} else if req = s.dropStalePoints(projectID, req); len(req.TimeSeries) != 0 {
+			if _, err := pd.metricClient(); err != nil {
+				exp.onSpoolError(fmt.Errorf("failed to replay spooled requests: %v", err), projectID, nil)
+				return false
+			}
+			if !pd.takeRateLimit(len(req.TimeSeries)) {
+				return false
+			}
+			err := pd.createTimeSeries(req)
+			if retryable(err) {
+				return false
+			}
+			if err != nil {
+				s.reportReplayError(projectID, req, err)
+			}
+		}
+
+		s.mu.Lock()
+		s.removeFile(file)
+		s.mu.Unlock()
+	}
+}
+
+// reportReplayError reports err, which is returned from uploading spooled req of the project. When
+// err tells which time series failed, only those are reported, grouped by causes of the failures.
+func (s *spool) reportReplayError(projectID string, req *monitoringpb.CreateTimeSeriesRequest, err error) {
+	exp := s.exp
+	failures, ok := parsePartialFailures(err, len(req.TimeSeries))
+	if !ok {
+		exp.onSpoolError(fmt.Errorf("RPC call to create time series failed for spooled request of project %s: %v", projectID, err), projectID, req.TimeSeries)
+		return
+	}
+	for _, failure := range failures {
+		timeSeries := make([]*monitoringpb.TimeSeries, len(failure.indices))
+		for i, idx := range failure.indices {
+			timeSeries[i] = req.TimeSeries[idx]
+		}
+		exp.onSpoolError(fmt.Errorf("RPC call to create time series failed for spooled request of project %s: %s", projectID, failure.cause), projectID, timeSeries)
+	}
+}
+
+func readSpoolFile(path string) (*monitoringpb.CreateTimeSeriesRequest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	req := &monitoringpb.CreateTimeSeriesRequest{}
+	if err := proto.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// dropStalePoints removes time series whose points are too old to be accepted by stackdriver from
+// req, and reports them.
+func (s *spool) dropStalePoints(projectID string, req *monitoringpb.CreateTimeSeriesRequest) *monitoringpb.CreateTimeSeriesRequest {
+	cutoff := time.Now().Add(-maxPointAge)
+	var timeSeries, stale []*monitoringpb.TimeSeries
+	for _, ts := range req.TimeSeries {
+		end := ts.Points[0].Interval.EndTime
+		if time.Unix(end.Seconds, int64(end.Nanos)).Before(cutoff) {
+			stale = append(stale, ts)
+			continue
+		}
+		timeSeries = append(timeSeries, ts)
+	}
+	if len(stale) != 0 {
+		s.exp.onSpoolError(fmt.Errorf("dropped %d time series of spooled request for project %s because their points are older than %v", len(stale), projectID, maxPointAge), projectID, stale)
+	}
+	req.TimeSeries = timeSeries
+	return req
+}
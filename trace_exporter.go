@@ -0,0 +1,180 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cloudtrace "cloud.google.com/go/trace/apiv2"
+	gax "github.com/googleapis/gax-go"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/api/support/bundler"
+	cloudtracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+)
+
+// TraceExporter is the exporter that can be registered to opencensus as a trace exporter. It exports
+// spans to multiple GCP projects in the same way StatsExporter does for stats. A TraceExporter
+// object must be created by NewTraceExporter().
+type TraceExporter struct {
+	ctx    context.Context
+	client traceClient
+	opts   *TraceOptions
+
+	// copy of some option values which may be modified by exporter.
+	getProjectID func(*trace.SpanData) (string, error)
+	onError      func(error, ...*trace.SpanData)
+
+	// mu protects access to projDataMap
+	mu sync.Mutex
+	// per-project data of exporter
+	projDataMap map[string]*traceProjectData
+}
+
+// TraceOptions designates various parameters used by trace exporter. Default value of fields in
+// TraceOptions are valid for use.
+type TraceOptions struct {
+	// ClientOptions designates options for creating trace client, especially credentials for
+	// RPC calls.
+	ClientOptions []option.ClientOption
+
+	// options for bundles amortizing export requests. Note that a bundle is created for each
+	// project. When not provided, default values in bundle package are used.
+	BundleDelayThreshold time.Duration
+	BundleCountThreshold int
+
+	// options for retrying failed RPC calls to write spans. They work in the same way as retry
+	// options of Options do for RPC calls to create time series.
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryTimeout        time.Duration
+
+	// callback functions provided by user.
+
+	// GetProjectID is used to filter whether given span data can be applicable to this exporter
+	// and if so, it also determines the projectID of given span data. If
+	// SpanDataNotApplicableError is returned, then the span data is not applicable to this
+	// exporter, and it will be silently ignored. Though not recommended, other errors can be
+	// returned, and in that case the error is reported to callers via OnError and the span data
+	// will not be uploaded. When GetProjectID is not set, all span data will be considered not
+	// applicable to this exporter.
+	GetProjectID func(*trace.SpanData) (projectID string, err error)
+	// OnError is used to report any error happened while exporting span data. Whenever this
+	// function is called, it's guaranteed that at least one span data is also passed to
+	// OnError. Span data passed to OnError must not be modified. When OnError is not set, all
+	// errors happened on exporting are ignored.
+	OnError func(error, ...*trace.SpanData)
+}
+
+// default values for trace options
+func defaultGetSpanProjectID(sd *trace.SpanData) (string, error) {
+	return "", SpanDataNotApplicableError
+}
+
+func defaultOnSpanError(err error, sds ...*trace.SpanData) {}
+
+// NewTraceExporter creates a TraceExporter object. Once a call to NewTraceExporter is made, any
+// fields in opts must not be modified at all. ctx will also be used throughout entire exporter
+// operation when making RPC call.
+func NewTraceExporter(ctx context.Context, opts *TraceOptions) (*TraceExporter, error) {
+	client, err := newTraceClient(ctx, opts.ClientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a trace client: %v", err)
+	}
+
+	e := &TraceExporter{
+		ctx:         ctx,
+		client:      client,
+		opts:        opts,
+		projDataMap: make(map[string]*traceProjectData),
+	}
+
+	// We don't want to modify user-supplied options, so save default options directly in
+	// exporter.
+	if opts.GetProjectID != nil {
+		e.getProjectID = opts.GetProjectID
+	} else {
+		e.getProjectID = defaultGetSpanProjectID
+	}
+	if opts.OnError != nil {
+		e.onError = opts.OnError
+	} else {
+		e.onError = defaultOnSpanError
+	}
+
+	return e, nil
+}
+
+// We wrap trace client and it's maker for testing.
+type traceClient interface {
+	BatchWriteSpans(context.Context, *cloudtracepb.BatchWriteSpansRequest, ...gax.CallOption) error
+	Close() error
+}
+
+var newTraceClient = defaultNewTraceClient
+
+func defaultNewTraceClient(ctx context.Context, opts ...option.ClientOption) (traceClient, error) {
+	return cloudtrace.NewClient(ctx, opts...)
+}
+
+// SpanDataNotApplicableError is used to tell that given span data is not applicable to the
+// exporter. See GetProjectID of TraceOptions for more detail.
+var SpanDataNotApplicableError = errors.New("span data is not applicable to the exporter, so it will be ignored")
+
+// ExportSpan is the method called by opencensus to export span data.
+func (e *TraceExporter) ExportSpan(sd *trace.SpanData) {
+	projID, err := e.getProjectID(sd)
+	if err != nil {
+		// We ignore non-applicable SpanData.
+		if err != SpanDataNotApplicableError {
+			newErr := fmt.Errorf("failed to get project ID on span data %s: %v", sd.Name, err)
+			e.onError(newErr, sd)
+		}
+		return
+	}
+	pd := e.getProjectData(projID)
+	switch err := pd.bndler.Add(sd, 1); err {
+	case nil:
+	case bundler.ErrOversizedItem:
+		pd.uploadOversized(sd)
+	default:
+		newErr := fmt.Errorf("failed to add span data %s to bundle for project %s: %v", sd.Name, projID, err)
+		e.onError(newErr, sd)
+	}
+}
+
+func (e *TraceExporter) getProjectData(projectID string) *traceProjectData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if pd, ok := e.projDataMap[projectID]; ok {
+		return pd
+	}
+
+	pd := e.newTraceProjectData(projectID)
+	e.projDataMap[projectID] = pd
+	return pd
+}
+
+// Close flushes and closes the exporter. Close must be called after the exporter is unregistered
+// and no further calls to ExportSpan() are made. Once Close() is returned no further access to the
+// exporter is allowed in any way.
+func (e *TraceExporter) Close() error {
+	// We don't hold mu while flushing, since flushing may take long.
+	e.mu.Lock()
+	pds := make([]*traceProjectData, 0, len(e.projDataMap))
+	for _, pd := range e.projDataMap {
+		pds = append(pds, pd)
+	}
+	e.mu.Unlock()
+	for _, pd := range pds {
+		pd.flush()
+	}
+
+	if err := e.client.Close(); err != nil {
+		return fmt.Errorf("failed to close the trace client: %v", err)
+	}
+	return nil
+}
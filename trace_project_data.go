@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/api/support/bundler"
+	cloudtracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+)
+
+// traceProjectData contain per-project data in trace exporter. It should be created by
+// newTraceProjectData()
+type traceProjectData struct {
+	parent    *TraceExporter
+	projectID string
+	// We make bundler for each project because call to trace RPC can be grouped only in project
+	// level
+	bndler spanBundler
+	// oversized waits for uploads of span data too large for the bundler, which are made outside
+	// of the bundler.
+	oversized sync.WaitGroup
+}
+
+// We wrap span bundler and its maker for testing purpose. Span bundler doesn't need AddWait() of
+// expBundler, since trace exporter has no overflow policy.
+type spanBundler interface {
+	Add(interface{}, int) error
+	Flush()
+}
+
+var newSpanBundler = defaultNewSpanBundler
+
+// defaultNewSpanBundler is the counterpart of defaultNewExpBundler for span data.
+func defaultNewSpanBundler(uploader func(interface{}), delayThreshold time.Duration, countThreshold int) spanBundler {
+	bndler := bundler.NewBundler((*trace.SpanData)(nil), uploader)
+
+	// Set options for bundler if they are provided by users.
+	if 0 < delayThreshold {
+		bndler.DelayThreshold = delayThreshold
+	}
+	if 0 < countThreshold {
+		bndler.BundleCountThreshold = countThreshold
+	}
+
+	return bndler
+}
+
+func (e *TraceExporter) newTraceProjectData(projectID string) *traceProjectData {
+	pd := &traceProjectData{
+		parent:    e,
+		projectID: projectID,
+	}
+
+	pd.bndler = newSpanBundler(pd.uploadSpanData, e.opts.BundleDelayThreshold, e.opts.BundleCountThreshold)
+	return pd
+}
+
+// uploadOversized uploads span data too large for the bundler in a separate goroutine. The upload
+// is waited by flush.
+func (pd *traceProjectData) uploadOversized(sd *trace.SpanData) {
+	pd.oversized.Add(1)
+	go func() {
+		defer pd.oversized.Done()
+		pd.uploadSpanData([]*trace.SpanData{sd})
+	}()
+}
+
+// flush flushes the bundler, and waits for uploads of oversized span data.
+func (pd *traceProjectData) flush() {
+	pd.bndler.Flush()
+	pd.oversized.Wait()
+}
+
+// uploadSpanData is called by bundler to upload span data, and report any error happened
+// meanwhile.
+func (pd *traceProjectData) uploadSpanData(bundle interface{}) {
+	exp := pd.parent
+	sds := bundle.([]*trace.SpanData)
+	if len(sds) == 0 {
+		return
+	}
+
+	spans := make([]*cloudtracepb.Span, len(sds))
+	for i, sd := range sds {
+		spans[i] = newSpan(sd, pd.projectID)
+	}
+	req := &cloudtracepb.BatchWriteSpansRequest{
+		Name:  fmt.Sprintf("projects/%s", pd.projectID),
+		Spans: spans,
+	}
+	if err := pd.writeSpans(req); err != nil {
+		newErr := fmt.Errorf("RPC call to write spans failed for project %s: %v", pd.projectID, err)
+		exp.onError(newErr, sds...)
+	}
+}
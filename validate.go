@@ -0,0 +1,49 @@
+package exporter
+
+import (
+	"fmt"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// MetricMismatchError is reported via OnError when a row data does not match the metric descriptor
+// of its project, so the row data is rejected before uploading. See ValidateRowData of Options.
+type MetricMismatchError struct {
+	ProjectID  string
+	MetricType string
+	// Reason describes how the row data mismatches the metric descriptor.
+	Reason string
+}
+
+func (e *MetricMismatchError) Error() string {
+	return fmt.Sprintf("row data mismatches metric %s of project %s: %s", e.MetricType, e.ProjectID, e.Reason)
+}
+
+// validateRowData checks that rd with labels, which is made by makeLabels(), matches the metric
+// descriptor desc.
+func (pd *projectData) validateRowData(rd *RowData, labels map[string]string, desc *metricpb.MetricDescriptor) error {
+	mismatch := func(format string, args ...interface{}) error {
+		return &MetricMismatchError{
+			ProjectID:  pd.projectID,
+			MetricType: desc.Type,
+			Reason:     fmt.Sprintf(format, args...),
+		}
+	}
+
+	if kind := pd.parent.metricKind(rd.View); kind != desc.MetricKind {
+		return mismatch("metric kind got: %v, want: %v", kind, desc.MetricKind)
+	}
+	if valType := valueType(rd.View); valType != desc.ValueType {
+		return mismatch("value type got: %v, want: %v", valType, desc.ValueType)
+	}
+	keySet := make(map[string]bool, len(desc.Labels))
+	for _, labelDesc := range desc.Labels {
+		keySet[labelDesc.Key] = true
+	}
+	for key := range labels {
+		if !keySet[key] {
+			return mismatch("label %s is not defined", key)
+		}
+	}
+	return nil
+}
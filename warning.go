@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	"go.opencensus.io/stats/view"
+)
+
+// WarningKind tells what kind of change is reported by a Warning.
+type WarningKind int
+
+const (
+	// LabelKeyRewritten means that a label key is rewritten to be a valid label key.
+	LabelKeyRewritten WarningKind = iota
+	// LabelKeyCollision means that a label is dropped because its rewritten key collides with
+	// that of another label.
+	LabelKeyCollision
+	// LabelDropped means that a label is dropped because the metric has too many labels.
+	LabelDropped
+	// LabelValueTruncated means that a label value is truncated because it's too long.
+	LabelValueTruncated
+	// CumulativeReset means that a cumulative time series is reset, like when the view is
+	// registered again or the process restarts. Start time of the point may be adjusted so that
+	// it doesn't overlap with the last point.
+	CumulativeReset
+	// CumulativeOutOfOrder means that a point of a cumulative time series is dropped because it
+	// isn't later than the last point of the series.
+	CumulativeOutOfOrder
+	// CumulativeStartMoved means that start time of a point of a cumulative time series moved
+	// backwards without reset, and it is replaced with the start time of the last point.
+	CumulativeStartMoved
+	// LabelUnknown means that a label of row data is dropped because it's neither a tag key of
+	// the view nor a default label.
+	LabelUnknown
+)
+
+var warningKindNames = map[WarningKind]string{
+	LabelKeyRewritten:    "LabelKeyRewritten",
+	LabelKeyCollision:    "LabelKeyCollision",
+	LabelDropped:         "LabelDropped",
+	LabelValueTruncated:  "LabelValueTruncated",
+	CumulativeReset:      "CumulativeReset",
+	CumulativeOutOfOrder: "CumulativeOutOfOrder",
+	CumulativeStartMoved: "CumulativeStartMoved",
+	LabelUnknown:         "LabelUnknown",
+}
+
+func (k WarningKind) String() string {
+	if name, ok := warningKindNames[k]; ok {
+		return name
+	}
+	return "UnknownWarning"
+}
+
+// Warning reports a change the exporter made on data being exported, so that users can find out
+// views those are not exported as they are. See OnWarning of Options.
+type Warning struct {
+	Kind WarningKind
+	// View is the view whose data is changed.
+	View *view.View
+	// RowData is the row data that is changed. It is nil when the change applies to all row
+	// data of View.
+	RowData *RowData
+	// Label is the original key of the label concerned. It is empty for warnings not concerning
+	// labels.
+	Label string
+	// Message describes the change.
+	Message string
+}
+
+func defaultOnWarning(w *Warning) {}